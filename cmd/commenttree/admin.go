@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/events"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/postgres"
+	"github.com/redis/go-redis/v9"
+	"github.com/wb-go/wbf/zlog"
+)
+
+// withAdminService runs fn against the service the API uses: the same
+// database, cache and event channel. Writes made here therefore invalidate
+// the shared Redis cache and reach live clients of every replica. rdb is nil
+// without Redis. The CLI acts without an actor, i.e. as trusted code.
+func withAdminService(fn func(ctx context.Context, svc service.CommentService, rdb *redis.Client) error) error {
+	pg := openPostgres()
+	defer pg.Close()
+
+	rdb := openRedis()
+	if rdb != nil {
+		defer rdb.Close()
+	}
+
+	opts := []service.Option{service.WithLanguage(searchLang())}
+	if rdb != nil {
+		// only publishing is needed, the local bus never gets subscribers
+		opts = append(opts, service.WithEvents(events.NewRedisBroker(rdb, events.NewBus(0))))
+	}
+	svc := service.New(postgres.New(pg.Pool), newCache(os.Getenv("CACHE"), rdb, intEnv("CACHE_SIZE", 10000)), opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return fn(ctx, svc, rdb)
+}
+
+// inProcessCache reports whether the API replicas cache in their own memory,
+// out of reach of this process.
+func inProcessCache(rdb *redis.Client) bool {
+	kind := os.Getenv("CACHE")
+	return kind == "lru" || (rdb == nil && kind != "none")
+}
+
+// warnUnshared is called before a write. Without Redis the replicas neither
+// see the cache invalidated nor get the event for their SSE clients.
+func warnUnshared(rdb *redis.Client) {
+	if inProcessCache(rdb) {
+		zlog.Logger.Warn().Dur("cache_ttl", durationEnv("CACHE_TTL", 2*time.Minute)).
+			Msg("the API replicas use an in-process cache and will serve the old data until it expires or they restart")
+	}
+	if rdb == nil {
+		zlog.Logger.Warn().Msg("redis not available, live clients will not be notified of the change")
+	}
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of biggest threads to list")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: commenttree stats [-top N] [-json]")
+	}
+
+	return withAdminService(func(ctx context.Context, svc service.CommentService, _ *redis.Client) error {
+		st, err := svc.Stats(ctx, *top)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(st)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "comments\t%d\n", st.Comments)
+		fmt.Fprintf(w, "deleted\t%d\n", st.Deleted)
+		fmt.Fprintf(w, "threads\t%d\n", st.Threads)
+		fmt.Fprintf(w, "max depth\t%d\n", st.MaxDepth)
+		if len(st.TopThreads) > 0 {
+			fmt.Fprintln(w, "\nthread\tcomments")
+			for _, t := range st.TopThreads {
+				fmt.Fprintf(w, "%s\t%d\n", t.ThreadKey, t.Comments)
+			}
+		}
+		return w.Flush()
+	})
+}
+
+func runDeleteSubtree(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: commenttree delete-subtree <id>")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid id %q", args[0])
+	}
+
+	return withAdminService(func(ctx context.Context, svc service.CommentService, rdb *redis.Client) error {
+		warnUnshared(rdb)
+		deleted, err := svc.DeleteSubtree(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %d comments\n", deleted)
+		return nil
+	})
+}
+
+func runCache(args []string) error {
+	if len(args) != 1 || args[0] != "flush" {
+		return errors.New("usage: commenttree cache flush")
+	}
+
+	return withAdminService(func(ctx context.Context, svc service.CommentService, rdb *redis.Client) error {
+		// in-process caches live in the API replicas and cannot be reached from here
+		if inProcessCache(rdb) || os.Getenv("CACHE") == "none" {
+			return errors.New("cache flush needs the Redis cache, in-process caches are only cleared by a restart")
+		}
+		if err := svc.FlushCache(ctx); err != nil {
+			return err
+		}
+		fmt.Println("cache flushed")
+		return nil
+	})
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	thread := fs.String("thread", "", "export every comment of this thread")
+	root := fs.Int64("root", 0, "export the subtree of this comment")
+	format := fs.String("format", "", "json or ndjson, by default taken from the -o extension")
+	out := fs.String("o", "-", "output file, - for stdout")
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 || (*thread == "") == (*root == 0) {
+		return errors.New("usage: commenttree export -thread KEY | -root ID [-format json|ndjson] [-o FILE]")
+	}
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "-" {
+		var err error
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return withAdminService(func(ctx context.Context, svc service.CommentService, _ *redis.Client) error {
+		if err := svc.Export(ctx, *thread, *root, fileFormat(*format, *out), w); err != nil {
+			return err
+		}
+		if f != nil {
+			// a failed close may lose the tail of the file
+			return f.Close()
+		}
+		return nil
+	})
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	thread := fs.String("thread", "", "thread of a top-level import, by default the exported one")
+	parent := fs.Int64("parent", 0, "attach the import under this comment")
+	format := fs.String("format", "", "json or ndjson, by default taken from the file extension")
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errors.New("usage: commenttree import [-thread KEY] [-parent ID] [-format json|ndjson] [FILE]")
+	}
+
+	in, name := os.Stdin, fs.Arg(0)
+	if name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return withAdminService(func(ctx context.Context, svc service.CommentService, rdb *redis.Client) error {
+		warnUnshared(rdb)
+		res, err := svc.Import(ctx, *thread, *parent, fileFormat(*format, name), bufio.NewReader(in))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported %d comments into thread %s, top-level ids %v\n", res.Imported, res.ThreadKey, res.Roots)
+		return nil
+	})
+}
+
+// fileFormat returns the format asked for, or the one the file name implies.
+func fileFormat(format, name string) service.Format {
+	if format != "" {
+		return service.Format(format)
+	}
+	switch filepath.Ext(name) {
+	case ".ndjson", ".jsonl":
+		return service.FormatNDJSON
+	}
+	return service.FormatJSON
+}
+
+func runFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.String("repair", "", "fix what is found: reroot or quarantine")
+	asJSON := fs.Bool("json", false, "print JSON instead of a summary")
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: commenttree fsck [-repair reroot|quarantine] [-json]")
+	}
+
+	return withAdminService(func(ctx context.Context, svc service.CommentService, rdb *redis.Client) error {
+		if *repair != "" {
+			warnUnshared(rdb)
+		}
+		r, err := svc.CheckIntegrity(ctx, *repair)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("checked %d comments\n", r.Checked)
+			fmt.Printf("orphans: %d %v\n", len(r.Orphans), r.Orphans)
+			fmt.Printf("cycles: %d %v\n", len(r.Cycles), r.Cycles)
+			fmt.Printf("unreachable: %d\n", r.Unreachable)
+			fmt.Printf("thread mismatches: %d %v\n", len(r.ThreadMismatches), r.ThreadMismatches)
+			fmt.Printf("depth anomalies: %d\n", len(r.DepthAnomalies))
+			if fix := r.Repair; fix != nil {
+				fmt.Printf("repaired (%s): %d reattached, %d rebuilt\n", fix.Strategy, fix.Reattached, fix.Rebuilt)
+				if fix.QuarantineID != 0 {
+					fmt.Printf("quarantined under comment %d in thread %s\n", fix.QuarantineID, service.QuarantineThread)
+				}
+			}
+		}
+		// like fsck(8), findings left unrepaired fail the run for scripts
+		if !r.OK() && r.Repair == nil {
+			return errors.New("integrity problems found")
+		}
+		return nil
+	})
+}
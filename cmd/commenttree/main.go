@@ -2,29 +2,78 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
 	"time"
 
-	commenthttp "github.com/MyNameIsWhaaat/commenttree/internal/comment/handler/http"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
-	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/postgres"
 	"github.com/redis/go-redis/v9"
 	pgxdriver "github.com/wb-go/wbf/dbpg/pgx-driver"
 	wbflogger "github.com/wb-go/wbf/logger"
 	"github.com/wb-go/wbf/zlog"
 )
 
+const usage = `usage: commenttree <command> [arguments]
+
+Commands:
+  serve                  run the HTTP API (the default)
+  migrate up [N|all]     apply N pending migrations, all by default
+  migrate down [N|all]   revert N migrations, 1 by default
+  migrate version        print the schema version
+  stats [-top N] [-json] count comments and list the biggest threads
+  delete-subtree <id>    delete a comment with all its replies
+  export -thread KEY | -root ID [-format F] [-o FILE]
+                         export a thread or subtree as json or ndjson
+  import [-thread KEY] [-parent ID] [-format F] [FILE]
+                         recreate an export under new ids
+  cache flush            make every cached page stale
+  fsck [-repair reroot|quarantine] [-json]
+                         find and repair orphaned and cyclic comments
+
+Every command is configured through the environment, see README.
+`
+
 func main() {
 	zlog.InitConsole()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "stats":
+		err = runStats(args)
+	case "delete-subtree":
+		err = runDeleteSubtree(args)
+	case "export":
+		err = runExport(args)
+	case "import":
+		err = runImport(args)
+	case "cache":
+		err = runCache(args)
+	case "fsck":
+		err = runFsck(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		zlog.Logger.Fatal().Err(err).Str("command", cmd).Msg("command failed")
 	}
+}
 
+// openPostgres connects to DATABASE_URL and exits when it cannot.
+func openPostgres() *pgxdriver.Postgres {
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
 		zlog.Logger.Fatal().Msg("DATABASE_URL is required")
@@ -46,75 +95,100 @@ func main() {
 	if err != nil {
 		zlog.Logger.Fatal().Err(err).Msg("failed to connect to database")
 	}
-	defer pg.Close()
 
 	if err := pg.Ping(ctx); err != nil {
 		zlog.Logger.Fatal().Err(err).Msg("failed to ping database")
 	}
+	return pg
+}
 
-	repo := postgres.New(pg.Pool)
+// openRedis connects to REDIS_ADDR. It returns nil when Redis is disabled or
+// unreachable, and callers fall back to what works without it.
+func openRedis() *redis.Client {
+	if os.Getenv("REDIS_DISABLED") != "" {
+		return nil
+	}
 
-	var rdb *redis.Client
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
 		redisAddr = "redis:6379"
 	}
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
 
-	if os.Getenv("REDIS_DISABLED") == "" {
-		rdb = redis.NewClient(&redis.Options{Addr: redisAddr})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		zlog.Logger.Warn().Err(err).Msg("redis not available")
+		_ = rdb.Close()
+		return nil
+	}
+	return rdb
+}
 
-		if err := rdb.Ping(ctx).Err(); err != nil {
-			zlog.Logger.Warn().Err(err).Msg("redis not available")
-			_ = rdb.Close()
-			rdb = nil
+// newCache picks the cache backend. By default Redis is used when it is
+// reachable and an in-process LRU otherwise.
+func newCache(kind string, rdb *redis.Client, size int) service.Cache {
+	if kind == "" {
+		kind = "redis"
+		if rdb == nil {
+			kind = "lru"
 		}
 	}
-
-	svc := service.New(repo, rdb)
-	h := commenthttp.New(svc)
-
-	srv := &http.Server{
-		Addr:              ":" + port,
-		Handler:           h.Routes(),
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      15 * time.Second,
-		IdleTimeout:       60 * time.Second,
+	if (kind == "redis" || kind == "tiered") && rdb == nil {
+		zlog.Logger.Warn().Str("cache", kind).Msg("redis not available, falling back to in-process cache")
+		kind = "lru"
 	}
 
-	errCh := make(chan error, 1)
-
-	go func() {
-		zlog.Logger.Info().Str("addr", srv.Addr).Msg("server starting")
-		errCh <- srv.ListenAndServe()
-	}()
-
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(stop)
-
-	select {
-	case sig := <-stop:
-		zlog.Logger.Info().Str("signal", sig.String()).Msg("shutdown signal received")
-	case err := <-errCh:
-		if err != nil && err != http.ErrServerClosed {
-			zlog.Logger.Error().Err(err).Msg("server error")
-		}
+	zlog.Logger.Info().Str("cache", kind).Msg("cache backend")
+	switch kind {
+	case "redis":
+		return service.NewRedisCache(rdb)
+	case "lru":
+		return service.NewLRUCache(size)
+	case "tiered":
+		return service.NewTieredCache(service.NewLRUCache(size), service.NewRedisCache(rdb))
+	case "none":
+		return service.NoopCache{}
+	default:
+		zlog.Logger.Fatal().Str("cache", kind).Msg("unknown CACHE, expected redis, lru, tiered or none")
+		return nil
 	}
+}
 
-	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func intEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		zlog.Logger.Fatal().Err(err).Str("key", key).Msg("invalid number")
+	}
+	return n
+}
 
-	if err := srv.Shutdown(ctx); err != nil {
-		zlog.Logger.Error().Err(err).Msg("http shutdown error")
-	} else {
-		zlog.Logger.Info().Msg("http server stopped")
+// searchLang is the text search configuration new comments are indexed with,
+// from SEARCH_LANG.
+func searchLang() model.Language {
+	lang := model.Language(os.Getenv("SEARCH_LANG"))
+	if lang == "" {
+		return model.LanguageSimple
 	}
+	if !lang.Valid() {
+		zlog.Logger.Fatal().Str("key", "SEARCH_LANG").Str("value", string(lang)).Msg("unknown text search language")
+	}
+	return lang
+}
 
-	if rdb != nil {
-		_ = rdb.Close()
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		zlog.Logger.Fatal().Err(err).Str("key", key).Msg("invalid duration")
 	}
+	return d
 }
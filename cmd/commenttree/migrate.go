@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/postgres"
+	"github.com/MyNameIsWhaaat/commenttree/migrations"
+)
+
+const migrateUsage = "usage: commenttree migrate up [N|all] | down [N|all] | version"
+
+// runMigrate applies the migrations built into the binary, so a deployment
+// needs no separate migration tool or copy of the migrations directory.
+func runMigrate(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+	action := args[0]
+
+	// up applies everything by default, down reverts one step: the safe choices
+	n := 0
+	if action == "down" {
+		n = 1
+	}
+	if len(args) == 2 {
+		if action == "version" {
+			return errors.New(migrateUsage)
+		}
+		var err error
+		if n, err = parseSteps(args[1]); err != nil {
+			return err
+		}
+	}
+
+	pg := openPostgres()
+	defer pg.Close()
+
+	m, err := postgres.NewMigrator(pg.Pool, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var done []int64
+	switch action {
+	case "up":
+		done, err = m.Up(ctx, n)
+		for _, v := range done {
+			fmt.Printf("applied %d\n", v)
+		}
+	case "down":
+		done, err = m.Down(ctx, n)
+		for _, v := range done {
+			fmt.Printf("reverted %d\n", v)
+		}
+	case "version":
+	default:
+		return errors.New(migrateUsage)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		fmt.Printf("version %d (dirty)\n", version)
+	} else {
+		fmt.Printf("version %d\n", version)
+	}
+	return nil
+}
+
+// parseSteps reads the number of migrations to run; "all" is 0.
+func parseSteps(s string) (int, error) {
+	if s == "all" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid number of migrations %q, expected a positive number or all", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/events"
+	commenthttp "github.com/MyNameIsWhaaat/commenttree/internal/comment/handler/http"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/ratelimit"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/inmemory"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/postgres"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/wb-go/wbf/zlog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// runServe runs the HTTP API until SIGINT or SIGTERM.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commenttree serve\n\nRuns the HTTP API. It is configured through the environment, see README.")
+	}
+	_ = fs.Parse(args)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	tp, shutdownTracing := newTracerProvider(os.Getenv("OTEL_TRACES_EXPORTER"))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	var opts []commenthttp.Option
+
+	var repo storage.Repository
+	switch os.Getenv("STORAGE") {
+	case "memory":
+		zlog.Logger.Warn().Msg("using in-memory storage, data is lost on restart")
+		repo = inmemory.New()
+	case "", "postgres":
+		pg := openPostgres()
+		defer pg.Close()
+
+		repo = postgres.New(pg.Pool)
+		reg.MustRegister(postgres.NewPoolCollector(pg.Pool))
+		opts = append(opts, commenthttp.WithReadinessCheck("postgres", pg.Pool.Ping))
+	default:
+		zlog.Logger.Fatal().Str("storage", os.Getenv("STORAGE")).Msg("unknown STORAGE, expected postgres or memory")
+	}
+
+	repo = storage.Trace(storage.Instrument(repo, reg), tp)
+
+	rdb := openRedis()
+	if rdb != nil {
+		if err := redisotel.InstrumentTracing(rdb, redisotel.WithTracerProvider(tp)); err != nil {
+			zlog.Logger.Warn().Err(err).Msg("failed to trace redis")
+		}
+		opts = append(opts, commenthttp.WithReadinessCheck("redis", func(ctx context.Context) error {
+			return rdb.Ping(ctx).Err()
+		}))
+	}
+
+	bus := events.NewBus(intEnv("EVENTS_REPLAY", 1024))
+	var publisher events.Publisher = bus
+
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	defer stopEvents()
+	if rdb != nil {
+		broker := events.NewRedisBroker(rdb, bus)
+		publisher = broker
+		go func() {
+			if err := broker.Run(eventsCtx); err != nil && eventsCtx.Err() == nil {
+				zlog.Logger.Error().Err(err).Msg("redis event relay stopped")
+			}
+		}()
+	}
+
+	svc := service.Trace(service.New(repo, newCache(os.Getenv("CACHE"), rdb, intEnv("CACHE_SIZE", 10000)),
+		service.WithEvents(publisher),
+		service.WithLanguage(searchLang()),
+		service.WithCacheTTL(durationEnv("CACHE_TTL", 2*time.Minute)),
+		service.WithStaleWhileRevalidate(durationEnv("CACHE_STALE_TTL", 0)),
+		service.WithMetrics(reg),
+	), tp)
+
+	if secret := os.Getenv("AUTH_JWT_SECRET"); secret != "" {
+		opts = append(opts, commenthttp.WithJWTSecret([]byte(secret)))
+	} else {
+		zlog.Logger.Warn().Msg("AUTH_JWT_SECRET is not set, authentication is disabled")
+	}
+	if os.Getenv("ADMIN_WITHOUT_AUTH") != "" {
+		zlog.Logger.Warn().Msg("ADMIN_WITHOUT_AUTH is set, admin endpoints are open to everyone while authentication is disabled")
+		opts = append(opts, commenthttp.WithAdminWithoutAuth())
+	}
+	opts = append(opts,
+		commenthttp.WithEvents(bus),
+		commenthttp.WithRateLimit(newLimiter(rdb), map[string]ratelimit.Limit{
+			"POST /comments":       limitEnv("RATE_LIMIT_CREATE", "10/m"),
+			"GET /comments/search": limitEnv("RATE_LIMIT_SEARCH", "60/m"),
+		}),
+		commenthttp.WithTrustedProxies(proxiesEnv("TRUSTED_PROXIES")...),
+		commenthttp.WithMetrics(reg),
+		commenthttp.WithTracing(tp),
+		commenthttp.WithLogger(zlog.Logger),
+	)
+	h := commenthttp.New(svc, opts...)
+
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	go runPurger(purgeCtx, svc, durationEnv("PURGE_RETENTION", 30*24*time.Hour), durationEnv("PURGE_INTERVAL", time.Hour))
+
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           h.Routes(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		// requests see shutdown through their context, which ends open event streams
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	srv.RegisterOnShutdown(cancelBase)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		zlog.Logger.Info().Str("addr", srv.Addr).Msg("server starting")
+		errCh <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case sig := <-stop:
+		zlog.Logger.Info().Str("signal", sig.String()).Msg("shutdown signal received")
+		// fail readiness first and give load balancers time to stop routing here
+		h.Drain()
+		time.Sleep(durationEnv("SHUTDOWN_DRAIN_DELAY", 5*time.Second))
+	case err := <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			zlog.Logger.Error().Err(err).Msg("server error")
+		}
+	}
+
+	stopPurge()
+	stopEvents()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		zlog.Logger.Error().Err(err).Msg("http shutdown error")
+	} else {
+		zlog.Logger.Info().Msg("http server stopped")
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		zlog.Logger.Error().Err(err).Msg("failed to flush traces")
+	}
+
+	if rdb != nil {
+		_ = rdb.Close()
+	}
+}
+
+// runPurger periodically hard-deletes soft-deleted comments older than
+// retention. A non-positive interval disables it.
+func runPurger(ctx context.Context, svc service.CommentService, retention, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			purged, err := svc.PurgeDeleted(ctx, retention)
+			if err != nil {
+				zlog.Logger.Error().Err(err).Msg("purge deleted comments failed")
+				continue
+			}
+			if purged > 0 {
+				zlog.Logger.Info().Int("purged", purged).Msg("purged deleted comments")
+			}
+		}
+	}
+}
+
+// newTracerProvider builds the tracer provider for OTEL_TRACES_EXPORTER:
+// "otlp" sends spans over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT, "stdout"
+// prints them, and "none" (the default) drops them.
+func newTracerProvider(exporter string) (trace.TracerProvider, func(context.Context) error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }
+	case "otlp":
+		exp, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		zlog.Logger.Fatal().Str("exporter", exporter).Msg("unknown OTEL_TRACES_EXPORTER, expected otlp, stdout or none")
+	}
+	if err != nil {
+		zlog.Logger.Fatal().Err(err).Msg("failed to create trace exporter")
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", "commenttree")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		zlog.Logger.Warn().Err(err).Msg("incomplete trace resource")
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	return tp, tp.Shutdown
+}
+
+// newLimiter shares rate limits through Redis when it is up; otherwise each
+// replica limits on its own.
+func newLimiter(rdb *redis.Client) ratelimit.Limiter {
+	if rdb == nil {
+		return ratelimit.NewMemory()
+	}
+	return ratelimit.NewRedis(rdb)
+}
+
+func limitEnv(key, def string) ratelimit.Limit {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+	l, err := ratelimit.ParseLimit(v)
+	if err != nil {
+		zlog.Logger.Fatal().Err(err).Str("key", key).Msg("invalid rate limit")
+	}
+	return l
+}
+
+// proxiesEnv reads a comma-separated list of CIDRs or single addresses.
+func proxiesEnv(key string) []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, s := range strings.Split(os.Getenv(key), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				zlog.Logger.Fatal().Err(err).Str("key", key).Msg("invalid proxy address")
+			}
+			p = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		proxies = append(proxies, p.Masked())
+	}
+	return proxies
+}
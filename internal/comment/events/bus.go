@@ -0,0 +1,144 @@
+package events
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+)
+
+type Type string
+
+const (
+	TypeCreated Type = "created"
+	TypeEdited  Type = "edited"
+	TypeDeleted Type = "deleted"
+)
+
+// Event is a change to one comment. Path lists the ids from the thread root
+// down to the comment itself, so subscribers can match whole subtrees.
+type Event struct {
+	ID        uint64        `json:"id"`
+	Type      Type          `json:"type"`
+	ThreadKey string        `json:"thread_key"`
+	Path      []int64       `json:"path"`
+	Comment   model.Comment `json:"comment"`
+	// Deleted is the number of removed comments for a subtree delete.
+	Deleted int `json:"deleted,omitempty"`
+}
+
+// Match reports whether the event belongs to the subtree of root (0 for any)
+// in thread (empty for any).
+func (e Event) Match(root int64, thread string) bool {
+	if thread != "" && e.ThreadKey != thread {
+		return false
+	}
+	return root == 0 || slices.Contains(e.Path, root)
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// subscriberBuffer is how far a subscriber may fall behind before it is cut
+// off; it then reconnects and catches up from the replay buffer.
+const subscriberBuffer = 64
+
+// Bus fans events out to the subscribers of this process and keeps the last
+// events around so reconnecting clients can resume by event id.
+type Bus struct {
+	mu     sync.Mutex
+	seq    uint64
+	replay []Event
+	size   int
+	subs   map[*Subscription]struct{}
+}
+
+func NewBus(replaySize int) *Bus {
+	return &Bus{
+		size: replaySize,
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish delivers e to every subscriber. Events without an id get the next
+// local one; ids assigned elsewhere (by the Redis broker) are kept as is.
+func (b *Bus) Publish(ctx context.Context, e Event) error {
+	_ = ctx
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.ID == 0 {
+		e.ID = b.seq + 1
+	}
+	b.seq = max(b.seq, e.ID)
+
+	if b.size > 0 {
+		if len(b.replay) == b.size {
+			b.replay = append(b.replay[:0], b.replay[1:]...)
+		}
+		b.replay = append(b.replay, e)
+	}
+
+	for s := range b.subs {
+		select {
+		case s.ch <- e:
+		default:
+			b.dropLocked(s)
+		}
+	}
+	return nil
+}
+
+type Subscription struct {
+	bus *Bus
+	ch  chan Event
+}
+
+// C yields events published after the subscription; it is closed when the
+// subscriber falls too far behind or the subscription is closed.
+func (s *Subscription) C() <-chan Event {
+	return s.ch
+}
+
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.dropLocked(s)
+}
+
+// Subscribe starts a subscription and returns the buffered events after
+// lastID. complete is false when events after lastID have already left the
+// buffer, or when lastID is ahead of this bus, e.g. on a replica that has
+// just started, so the caller may have missed some and has to reload.
+func (b *Bus) Subscribe(lastID uint64) (sub *Subscription, replay []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &Subscription{bus: b, ch: make(chan Event, subscriberBuffer)}
+	b.subs[sub] = struct{}{}
+
+	if lastID == 0 || lastID == b.seq {
+		return sub, nil, true
+	}
+	if lastID > b.seq {
+		return sub, nil, false
+	}
+
+	i, _ := slices.BinarySearchFunc(b.replay, lastID+1, func(e Event, id uint64) int {
+		return cmp.Compare(e.ID, id)
+	})
+	replay = slices.Clone(b.replay[i:])
+	complete = i > 0 || (len(b.replay) > 0 && b.replay[0].ID == lastID+1)
+	return sub, replay, complete
+}
+
+func (b *Bus) dropLocked(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
@@ -0,0 +1,124 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestBusReplayAndMatch(t *testing.T) {
+	ctx := context.Background()
+	bus := NewBus(3)
+
+	for i := int64(1); i <= 5; i++ {
+		_ = bus.Publish(ctx, Event{Type: TypeCreated, ThreadKey: "t", Path: []int64{1, i}})
+	}
+
+	_, replay, complete := bus.Subscribe(3)
+	if !complete || len(replay) != 2 || replay[0].ID != 4 || replay[1].ID != 5 {
+		t.Fatalf("unexpected replay after 3: complete=%v %+v", complete, replay)
+	}
+
+	_, replay, complete = bus.Subscribe(1)
+	if complete || len(replay) != 3 {
+		t.Fatalf("expected incomplete replay after evicted id, got complete=%v %d events", complete, len(replay))
+	}
+
+	sub, replay, complete := bus.Subscribe(5)
+	if !complete || len(replay) != 0 {
+		t.Fatalf("expected nothing to replay for the latest id, got %+v", replay)
+	}
+	_ = bus.Publish(ctx, Event{Type: TypeEdited, ThreadKey: "t", Path: []int64{1, 2}})
+	e := <-sub.C()
+	if e.ID != 6 || !e.Match(2, "") || !e.Match(0, "t") || e.Match(3, "") || e.Match(0, "other") {
+		t.Fatalf("unexpected live event %+v", e)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C(); ok {
+		t.Fatalf("expected closed channel after Close")
+	}
+}
+
+func TestBusResumeAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	bus := NewBus(8)
+
+	// ids come from Redis and are far ahead of what a fresh bus has seen
+	_, replay, complete := bus.Subscribe(100)
+	if complete || len(replay) != 0 {
+		t.Fatalf("expected a reset from a fresh bus, got complete=%v %+v", complete, replay)
+	}
+
+	_ = bus.Publish(ctx, Event{ID: 105, Type: TypeCreated})
+	_, replay, complete = bus.Subscribe(100)
+	if complete || len(replay) != 1 || replay[0].ID != 105 {
+		t.Fatalf("expected a reset when 101-104 were never seen, got complete=%v %+v", complete, replay)
+	}
+
+	_, replay, complete = bus.Subscribe(104)
+	if !complete || len(replay) != 1 || replay[0].ID != 105 {
+		t.Fatalf("expected a complete replay after 104, got complete=%v %+v", complete, replay)
+	}
+}
+
+func TestBusDropsSlowSubscriber(t *testing.T) {
+	bus := NewBus(0)
+	sub, _, _ := bus.Subscribe(0)
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		_ = bus.Publish(context.Background(), Event{Type: TypeCreated})
+	}
+
+	n := 0
+	for range sub.C() {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Fatalf("expected %d buffered events before the cut, got %d", subscriberBuffer, n)
+	}
+}
+
+func TestRedisBrokerSharesIDs(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// two replicas sharing one Redis
+	busA, busB := NewBus(8), NewBus(8)
+	a, b := NewRedisBroker(rdb, busA), NewRedisBroker(rdb, busB)
+	subA, _, _ := busA.Subscribe(0)
+	subB, _, _ := busB.Subscribe(0)
+	go func() { _ = a.Run(ctx) }()
+	go func() { _ = b.Run(ctx) }()
+
+	for mr.PubSubNumSub(redisChannel)[redisChannel] < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := a.Publish(ctx, Event{Type: TypeCreated, ThreadKey: "t"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := b.Publish(ctx, Event{Type: TypeEdited, ThreadKey: "t"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	for _, sub := range []*Subscription{subA, subB} {
+		for want := uint64(1); want <= 2; want++ {
+			select {
+			case e := <-sub.C():
+				if e.ID != want {
+					t.Fatalf("expected id %d, got %+v", want, e)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for event %d", want)
+			}
+		}
+	}
+}
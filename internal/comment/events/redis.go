@@ -0,0 +1,87 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisChannel = "comments:events"
+	redisSeqKey  = "comments:events:seq"
+)
+
+// publishScript numbers the event and publishes it in one step, so ids grow in
+// the order events reach subscribers even with several replicas publishing.
+var publishScript = redis.NewScript(`
+local id = redis.call('INCR', KEYS[1])
+redis.call('PUBLISH', KEYS[2], id .. '\n' .. ARGV[1])
+return id
+`)
+
+// RedisBroker shares events between API replicas: Publish sends them through
+// Redis pub/sub and Run feeds everything received, including this replica's
+// own events, into the local bus. Ids come from a Redis counter and are the
+// same on every replica, so a client can resume on any of them.
+type RedisBroker struct {
+	rdb *redis.Client
+	bus *Bus
+}
+
+func NewRedisBroker(rdb *redis.Client, bus *Bus) *RedisBroker {
+	return &RedisBroker{rdb: rdb, bus: bus}
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, e Event) error {
+	e.ID = 0
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return publishScript.Run(ctx, b.rdb, []string{redisSeqKey, redisChannel}, payload).Err()
+}
+
+// Run relays events from Redis to the local bus until ctx is done.
+func (b *RedisBroker) Run(ctx context.Context) error {
+	sub := b.rdb.Subscribe(ctx, redisChannel)
+	defer sub.Close()
+
+	// fail fast when Redis is unreachable instead of retrying in the background
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			e, err := decodeMessage(msg.Payload)
+			if err != nil {
+				continue
+			}
+			_ = b.bus.Publish(ctx, e)
+		}
+	}
+}
+
+func decodeMessage(payload string) (Event, error) {
+	idStr, body, _ := strings.Cut(payload, "\n")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return Event{}, err
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		return Event{}, err
+	}
+	e.ID = id
+	return e, nil
+}
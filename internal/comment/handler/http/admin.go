@@ -0,0 +1,68 @@
+package http
+
+import (
+	stdhttp "net/http"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+)
+
+// WithAdminWithoutAuth opens the admin endpoints to every caller while
+// authentication is off, e.g. for local development. Otherwise they need an
+// admin token, and trusted use goes through the CLI.
+func WithAdminWithoutAuth() Option {
+	return func(h *Handler) {
+		h.openAdmin = true
+	}
+}
+
+// requireAdmin lets only admins through. Without authentication callers have
+// no actor, which the service would treat as trusted code, so the admin
+// endpoints are refused unless opened with WithAdminWithoutAuth.
+func (h *Handler) requireAdmin(w stdhttp.ResponseWriter, r *stdhttp.Request) bool {
+	if len(h.jwtSecret) == 0 {
+		if h.openAdmin {
+			return true
+		}
+		writeProblem(w, stdhttp.StatusForbidden, codeForbidden, "", "admin endpoints need authentication")
+		return false
+	}
+	a, ok := service.ActorFrom(r.Context())
+	if !ok {
+		unauthorized(w)
+		return false
+	}
+	if !a.Admin {
+		writeProblem(w, stdhttp.StatusForbidden, codeForbidden, "", "admin only")
+		return false
+	}
+	return true
+}
+
+// CheckIntegrity reports broken tree links on GET and repairs them on POST
+// with ?repair=reroot or ?repair=quarantine.
+func (h *Handler) CheckIntegrity(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	repair := ""
+	switch r.Method {
+	case stdhttp.MethodGet:
+	case stdhttp.MethodPost:
+		repair = r.URL.Query().Get("repair")
+		if repair == "" {
+			badRequest(w, "repair", service.CodeInvalidRepair, "must be reroot or quarantine")
+			return
+		}
+	default:
+		stdhttp.NotFound(w, r)
+		return
+	}
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	report, err := h.svc.CheckIntegrity(r.Context(), repair)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, report)
+}
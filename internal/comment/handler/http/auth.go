@@ -0,0 +1,133 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	stdhttp "net/http"
+	"strings"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// WithJWTSecret enables bearer authentication with HS256 tokens signed by
+// secret. Without it the API is open and comments are anonymous.
+func WithJWTSecret(secret []byte) Option {
+	return func(h *Handler) {
+		h.jwtSecret = secret
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Sub   string   `json:"sub"`
+	Name  string   `json:"name"`
+	Role  string   `json:"role"`
+	Roles []string `json:"roles"`
+	Exp   int64    `json:"exp"`
+	Nbf   int64    `json:"nbf"`
+}
+
+func (c jwtClaims) admin() bool {
+	if c.Role == "admin" {
+		return true
+	}
+	for _, r := range c.Roles {
+		if r == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWT verifies an HS256 token and returns the actor it names.
+func parseJWT(token string, secret []byte, now time.Time) (service.Actor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return service.Actor{}, errInvalidToken
+	}
+
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil || hdr.Alg != "HS256" {
+		return service.Actor{}, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return service.Actor{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return service.Actor{}, errInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return service.Actor{}, errInvalidToken
+	}
+	if claims.Sub == "" {
+		return service.Actor{}, errInvalidToken
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return service.Actor{}, errInvalidToken
+	}
+	if claims.Nbf != 0 && now.Unix() < claims.Nbf {
+		return service.Actor{}, errInvalidToken
+	}
+
+	return service.Actor{ID: claims.Sub, Name: claims.Name, Admin: claims.admin()}, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// authenticate puts the bearer of a valid token into the request context.
+// Reads stay public; anything that changes data needs a token.
+func (h *Handler) authenticate(next stdhttp.Handler) stdhttp.Handler {
+	if len(h.jwtSecret) == 0 {
+		return next
+	}
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		authz := r.Header.Get("Authorization")
+		if authz == "" {
+			if r.Method == stdhttp.MethodGet || r.Method == stdhttp.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			unauthorized(w)
+			return
+		}
+
+		token, ok := strings.CutPrefix(authz, "Bearer ")
+		if !ok {
+			unauthorized(w)
+			return
+		}
+		actor, err := parseJWT(strings.TrimSpace(token), h.jwtSecret, time.Now())
+		if err != nil {
+			unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(service.WithActor(r.Context(), actor)))
+	})
+}
+
+func unauthorized(w stdhttp.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="commenttree"`)
+	writeProblem(w, stdhttp.StatusUnauthorized, codeUnauthorized, "", "missing or invalid bearer token")
+}
@@ -2,45 +2,61 @@ package http
 
 import (
 	"encoding/json"
-	"errors"
 	stdhttp "net/http"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/events"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+	"github.com/rs/zerolog"
 )
 
 type Handler struct {
-	svc service.CommentService
+	svc       service.CommentService
+	jwtSecret []byte
+	events    *events.Bus
+	heartbeat time.Duration
+	metrics   *httpMetrics
+	tracing   *httpTracing
+	logger    zerolog.Logger
+	checks    []readinessCheck
+	draining  atomic.Bool
+	limits    *rateLimits
+	proxies   []netip.Prefix
+	openAdmin bool
 }
 
-func New(svc service.CommentService) *Handler {
-	return &Handler{svc: svc}
+type Option func(*Handler)
+
+func New(svc service.CommentService, opts ...Option) *Handler {
+	h := &Handler{svc: svc, heartbeat: defaultHeartbeat, logger: zerolog.Nop()}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 type createCommentRequest struct {
-	ParentID int64  `json:"parent_id"`
-	Text     string `json:"text"`
+	ThreadKey string         `json:"thread_key"`
+	ParentID  int64          `json:"parent_id"`
+	Lang      model.Language `json:"lang"`
+	Text      string         `json:"text"`
 }
 
 func (h *Handler) CreateComment(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	var req createCommentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "bad json"})
+		badRequest(w, "", codeBadJSON, "request body is not valid JSON")
 		return
 	}
 
-	c, err := h.svc.Create(r.Context(), req.ParentID, req.Text)
+	c, err := h.svc.Create(r.Context(), req.ThreadKey, req.ParentID, req.Lang, req.Text)
 	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrInvalidInput):
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid input"})
-		case errors.Is(err, service.ErrNotFound):
-			writeJSON(w, stdhttp.StatusNotFound, map[string]any{"error": "parent not found"})
-		default:
-			writeJSON(w, stdhttp.StatusInternalServerError, map[string]any{"error": "internal error"})
-		}
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -54,7 +70,7 @@ func (h *Handler) GetComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	if v := q.Get("parent"); v != "" {
 		parsed, err := parseInt64(v)
 		if err != nil {
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid parent"})
+			badRequest(w, "parent", service.CodeInvalidParent, "must be an integer")
 			return
 		}
 		parentID = parsed
@@ -64,7 +80,7 @@ func (h *Handler) GetComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	if v := q.Get("page"); v != "" {
 		parsed, err := parseInt(v)
 		if err != nil {
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid page"})
+			badRequest(w, "page", service.CodePageOutOfRange, "must be an integer")
 			return
 		}
 		page = parsed
@@ -74,7 +90,7 @@ func (h *Handler) GetComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	if v := q.Get("limit"); v != "" {
 		parsed, err := parseInt(v)
 		if err != nil {
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid limit"})
+			badRequest(w, "limit", service.CodeLimitOutOfRange, "must be an integer")
 			return
 		}
 		limit = parsed
@@ -82,48 +98,164 @@ func (h *Handler) GetComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 
 	sortMode := model.Sort(q.Get("sort"))
 
-	res, err := h.svc.GetTreePage(r.Context(), parentID, page, limit, sortMode)
+	res, err := h.svc.GetTreePage(r.Context(), q.Get("thread"), parentID, page, limit, sortMode, q.Get("cursor"))
 	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrInvalidInput):
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid input"})
-		case errors.Is(err, service.ErrNotFound):
-			writeJSON(w, stdhttp.StatusNotFound, map[string]any{"error": "parent not found"})
-		default:
-			writeJSON(w, stdhttp.StatusInternalServerError, map[string]any{"error": "internal error"})
-		}
+		h.writeError(w, r, err)
 		return
 	}
 
 	writeJSON(w, stdhttp.StatusOK, res)
 }
 
+type updateCommentRequest struct {
+	Text string `json:"text"`
+}
+
+func (h *Handler) UpdateComment(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	idStr, _ := commentPath(r.URL.Path)
+	id, err := parseInt64(idStr)
+	if err != nil || id <= 0 {
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
+		return
+	}
+
+	var req updateCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "", codeBadJSON, "request body is not valid JSON")
+		return
+	}
+
+	c, err := h.svc.Update(r.Context(), id, req.Text)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, c)
+}
+
+func (h *Handler) GetRevisions(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	idStr, _ := commentPath(r.URL.Path)
+	id, err := parseInt64(idStr)
+	if err != nil || id <= 0 {
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
+		return
+	}
+
+	items, err := h.svc.GetRevisions(r.Context(), id)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, map[string]any{"items": items})
+}
+
 func (h *Handler) DeleteComment(w stdhttp.ResponseWriter, r *stdhttp.Request) {
-	// Expect path like /comments/{id}
-	p := strings.TrimPrefix(r.URL.Path, "/comments/")
-	idStr := strings.Trim(p, "/")
+	idStr, _ := commentPath(r.URL.Path)
 	id, err := parseInt64(idStr)
 	if err != nil || id <= 0 {
-		writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid id"})
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
+		return
+	}
+
+	if r.URL.Query().Get("mode") == "soft" {
+		h.softDeleteComment(w, r, id)
 		return
 	}
 
 	deleted, err := h.svc.DeleteSubtree(r.Context(), id)
 	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrInvalidInput):
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid input"})
-		case errors.Is(err, service.ErrNotFound):
-			writeJSON(w, stdhttp.StatusNotFound, map[string]any{"error": "not found"})
-		default:
-			writeJSON(w, stdhttp.StatusInternalServerError, map[string]any{"error": "internal error"})
-		}
+		h.writeError(w, r, err)
 		return
 	}
 
 	writeJSON(w, stdhttp.StatusOK, map[string]any{"deleted": deleted})
 }
 
+func (h *Handler) softDeleteComment(w stdhttp.ResponseWriter, r *stdhttp.Request, id int64) {
+	c, err := h.svc.SoftDelete(r.Context(), id, r.URL.Query().Get("by"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, c)
+}
+
+func (h *Handler) RestoreComment(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	idStr, _ := commentPath(r.URL.Path)
+	id, err := parseInt64(idStr)
+	if err != nil || id <= 0 {
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
+		return
+	}
+
+	c, err := h.svc.Restore(r.Context(), id)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, c)
+}
+
+type moveCommentRequest struct {
+	ParentID int64 `json:"parent_id"`
+}
+
+func (h *Handler) MoveComment(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	idStr, _ := commentPath(r.URL.Path)
+	id, err := parseInt64(idStr)
+	if err != nil || id <= 0 {
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
+		return
+	}
+
+	var req moveCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "", codeBadJSON, "request body is not valid JSON")
+		return
+	}
+
+	c, err := h.svc.Move(r.Context(), id, req.ParentID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, c)
+}
+
+type voteCommentRequest struct {
+	Value int `json:"value"`
+}
+
+func (h *Handler) VoteComment(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	idStr, _ := commentPath(r.URL.Path)
+	id, err := parseInt64(idStr)
+	if err != nil || id <= 0 {
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
+		return
+	}
+
+	var req voteCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "", codeBadJSON, "request body is not valid JSON")
+		return
+	}
+
+	// the service votes as the authenticated user; anonymous clients cannot
+	// name themselves, so they vote by address
+	c, err := h.svc.Vote(r.Context(), id, "ip:"+h.clientIP(r), req.Value)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusOK, c)
+}
+
 func (h *Handler) SearchComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	qp := r.URL.Query()
 
@@ -132,7 +264,7 @@ func (h *Handler) SearchComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	if v := qp.Get("page"); v != "" {
 		p, err := parseInt(v)
 		if err != nil {
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid page"})
+			badRequest(w, "page", service.CodePageOutOfRange, "must be an integer")
 			return
 		}
 		page = p
@@ -141,7 +273,7 @@ func (h *Handler) SearchComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	if v := qp.Get("limit"); v != "" {
 		l, err := parseInt(v)
 		if err != nil {
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid limit"})
+			badRequest(w, "limit", service.CodeLimitOutOfRange, "must be an integer")
 			return
 		}
 		limit = l
@@ -149,14 +281,9 @@ func (h *Handler) SearchComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 
 	sortMode := model.Sort(qp.Get("sort"))
 
-	res, err := h.svc.Search(r.Context(), q, page, limit, sortMode)
+	res, err := h.svc.Search(r.Context(), qp.Get("thread"), q, model.Language(qp.Get("lang")), page, limit, sortMode, qp.Get("cursor"))
 	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrInvalidInput):
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid input"})
-		default:
-			writeJSON(w, stdhttp.StatusInternalServerError, map[string]any{"error": "internal error"})
-		}
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -167,20 +294,13 @@ func (h *Handler) GetPath(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	idStr := r.URL.Query().Get("id")
 	id, err := parseInt64(idStr)
 	if err != nil || id <= 0 {
-		writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid id"})
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
 		return
 	}
 
 	items, err := h.svc.GetPath(r.Context(), id)
 	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrInvalidInput):
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid input"})
-		case errors.Is(err, service.ErrNotFound):
-			writeJSON(w, stdhttp.StatusNotFound, map[string]any{"error": "not found"})
-		default:
-			writeJSON(w, stdhttp.StatusInternalServerError, map[string]any{"error": "internal error"})
-		}
+		h.writeError(w, r, err)
 		return
 	}
 	writeJSON(w, stdhttp.StatusOK, map[string]any{"items": items})
@@ -190,7 +310,7 @@ func (h *Handler) GetSubtree(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 	idStr := r.URL.Query().Get("id")
 	id, err := parseInt64(idStr)
 	if err != nil || id <= 0 {
-		writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid id"})
+		badRequest(w, "id", service.CodeInvalidID, "must be a positive integer")
 		return
 	}
 
@@ -198,20 +318,20 @@ func (h *Handler) GetSubtree(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 
 	node, err := h.svc.GetSubtree(r.Context(), id, sortMode)
 	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrInvalidInput):
-			writeJSON(w, stdhttp.StatusBadRequest, map[string]any{"error": "invalid input"})
-		case errors.Is(err, service.ErrNotFound):
-			writeJSON(w, stdhttp.StatusNotFound, map[string]any{"error": "not found"})
-		default:
-			writeJSON(w, stdhttp.StatusInternalServerError, map[string]any{"error": "internal error"})
-		}
+		h.writeError(w, r, err)
 		return
 	}
 
 	writeJSON(w, stdhttp.StatusOK, node)
 }
 
+// commentPath splits /comments/{id}[/{action}] into the id and action parts.
+func commentPath(p string) (id, action string) {
+	p = strings.Trim(strings.TrimPrefix(p, "/comments/"), "/")
+	id, action, _ = strings.Cut(p, "/")
+	return id, action
+}
+
 func writeJSON(w stdhttp.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
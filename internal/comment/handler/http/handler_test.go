@@ -1,40 +1,41 @@
 package http_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
-	"database/sql"
-
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/events"
 	handler "github.com/MyNameIsWhaaat/commenttree/internal/comment/handler/http"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/ratelimit"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage"
 	inm "github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/inmemory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-// fakeRepo wraps inmemory.Repo and implements missing methods required by storage.Repository
-type fakeRepo struct{ *inm.Repo }
-
-func (f *fakeRepo) Search(ctx context.Context, q string, page, limit int, sort model.Sort) (model.SearchPage, error) {
-	return model.SearchPage{}, nil
-}
-
-func (f *fakeRepo) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
-	return model.CommentNode{}, sql.ErrNoRows
-}
-
-func (f *fakeRepo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
-	return nil, sql.ErrNoRows
-}
-
-func newServer() (*httptest.Server, *fakeRepo) {
-	repo := &fakeRepo{inm.New()}
+func newServer() (*httptest.Server, *inm.Repo) {
+	repo := inm.New()
 	svc := service.New(repo, nil)
 	h := handler.New(svc)
 	srv := httptest.NewServer(h.Routes())
@@ -46,7 +47,7 @@ func TestCreateGetDeleteComments(t *testing.T) {
 	defer srv.Close()
 
 	// create root
-	reqBody := map[string]any{"parent_id": 0, "text": "root"}
+	reqBody := map[string]any{"thread_key": "t", "parent_id": 0, "text": "root"}
 	b, _ := json.Marshal(reqBody)
 	res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
 	if err != nil {
@@ -169,3 +170,1156 @@ func TestHandlerValidationErrors(t *testing.T) {
 	}
 	_ = res.Body.Close()
 }
+
+func TestUpdateCommentAndRevisions(t *testing.T) {
+	srv, _ := newServer()
+	defer srv.Close()
+
+	b, _ := json.Marshal(map[string]any{"thread_key": "t", "parent_id": 0, "text": "draft"})
+	res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("post create: %v", err)
+	}
+	var created model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create: %v", err)
+	}
+	_ = res.Body.Close()
+
+	client := &http.Client{}
+	idURL := srv.URL + "/comments/" + strconv.FormatInt(created.ID, 10)
+
+	b, _ = json.Marshal(map[string]any{"text": "final"})
+	req, _ := http.NewRequest(http.MethodPatch, idURL, bytes.NewReader(b))
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("patch request: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on patch, got %d", res.StatusCode)
+	}
+	var updated model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&updated); err != nil {
+		t.Fatalf("decode patch: %v", err)
+	}
+	_ = res.Body.Close()
+	if updated.Text != "final" || updated.EditedAt == nil {
+		t.Fatalf("unexpected updated comment: %+v", updated)
+	}
+
+	res, err = http.Get(idURL + "/revisions")
+	if err != nil {
+		t.Fatalf("get revisions: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on revisions, got %d", res.StatusCode)
+	}
+	var revs struct {
+		Items []model.CommentRevision `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&revs); err != nil {
+		t.Fatalf("decode revisions: %v", err)
+	}
+	_ = res.Body.Close()
+	if len(revs.Items) != 1 || revs.Items[0].Text != "draft" {
+		t.Fatalf("unexpected revisions: %+v", revs.Items)
+	}
+
+	req, _ = http.NewRequest(http.MethodPatch, srv.URL+"/comments/9999", bytes.NewReader(b))
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("patch missing: %v", err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 on patch of missing comment, got %d", res.StatusCode)
+	}
+	_ = res.Body.Close()
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	srv, _ := newServer()
+	defer srv.Close()
+
+	b, _ := json.Marshal(map[string]any{"thread_key": "t", "parent_id": 0, "text": "oops"})
+	res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("post create: %v", err)
+	}
+	var created model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create: %v", err)
+	}
+	_ = res.Body.Close()
+
+	idURL := srv.URL + "/comments/" + strconv.FormatInt(created.ID, 10)
+
+	client := &http.Client{}
+	req, _ := http.NewRequest(http.MethodDelete, idURL+"?mode=soft&by=mod", nil)
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on soft delete, got %d", res.StatusCode)
+	}
+	var tomb model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&tomb); err != nil {
+		t.Fatalf("decode soft delete: %v", err)
+	}
+	_ = res.Body.Close()
+	if tomb.Text != model.DeletedText || tomb.DeletedBy != "mod" {
+		t.Fatalf("unexpected tombstone: %+v", tomb)
+	}
+
+	res, err = http.Post(idURL+"/restore", "application/json", nil)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on restore, got %d", res.StatusCode)
+	}
+	var restored model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&restored); err != nil {
+		t.Fatalf("decode restore: %v", err)
+	}
+	_ = res.Body.Close()
+	if restored.Text != "oops" || restored.DeletedAt != nil {
+		t.Fatalf("unexpected restored comment: %+v", restored)
+	}
+}
+
+func TestMoveComment(t *testing.T) {
+	srv, _ := newServer()
+	defer srv.Close()
+
+	create := func(parentID int64, text string) model.Comment {
+		b, _ := json.Marshal(map[string]any{"thread_key": "t", "parent_id": parentID, "text": text})
+		res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("post create: %v", err)
+		}
+		defer res.Body.Close()
+		var c model.Comment
+		if err := json.NewDecoder(res.Body).Decode(&c); err != nil {
+			t.Fatalf("decode create: %v", err)
+		}
+		return c
+	}
+
+	root := create(0, "root")
+	child := create(root.ID, "child")
+	other := create(0, "other")
+
+	move := func(id, parentID int64) *http.Response {
+		b, _ := json.Marshal(map[string]any{"parent_id": parentID})
+		res, err := http.Post(srv.URL+"/comments/"+strconv.FormatInt(id, 10)+"/move", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("move: %v", err)
+		}
+		return res
+	}
+
+	res := move(root.ID, child.ID)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for cyclic move, got %d", res.StatusCode)
+	}
+	_ = res.Body.Close()
+
+	res = move(child.ID, other.ID)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on move, got %d", res.StatusCode)
+	}
+	var moved model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&moved); err != nil {
+		t.Fatalf("decode move: %v", err)
+	}
+	_ = res.Body.Close()
+	if moved.ParentID != other.ID {
+		t.Fatalf("expected parent %d, got %d", other.ID, moved.ParentID)
+	}
+}
+
+func TestRevisionsOfSoftDeletedComment(t *testing.T) {
+	svc := service.New(inm.New(), nil)
+	srv := httptest.NewServer(handler.New(svc, handler.WithJWTSecret(testSecret)).Routes())
+	defer srv.Close()
+
+	alice := signToken(t, map[string]any{"sub": "alice"})
+	admin := signToken(t, map[string]any{"sub": "mod", "role": "admin"})
+
+	b, _ := json.Marshal(map[string]any{"thread_key": "t", "parent_id": 0, "text": "secret draft"})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/comments", bytes.NewReader(b))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var created model.Comment
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	_ = res.Body.Close()
+
+	url := srv.URL + "/comments/" + strconv.FormatInt(created.ID, 10)
+	if res := doAuth(t, http.MethodPatch, url, alice, map[string]any{"text": "final"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on edit, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodDelete, url+"?mode=soft", alice, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on soft delete, got %d", res.StatusCode)
+	}
+
+	revisions := func(token string) []model.CommentRevision {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url+"/revisions", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get revisions: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 on revisions, got %d", res.StatusCode)
+		}
+		var revs struct {
+			Items []model.CommentRevision `json:"items"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&revs); err != nil {
+			t.Fatalf("decode revisions: %v", err)
+		}
+		return revs.Items
+	}
+
+	for _, token := range []string{"", alice} {
+		if revs := revisions(token); len(revs) != 1 || revs[0].Text != model.DeletedText {
+			t.Fatalf("expected masked revisions, got %+v", revs)
+		}
+	}
+	if revs := revisions(admin); len(revs) != 1 || revs[0].Text != "secret draft" {
+		t.Fatalf("expected admins to see the history, got %+v", revs)
+	}
+}
+
+func TestExportOfSoftDeletedComment(t *testing.T) {
+	svc := service.New(inm.New(), nil)
+	srv := httptest.NewServer(handler.New(svc, handler.WithJWTSecret(testSecret)).Routes())
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, _ := svc.Create(ctx, "t", 0, "", "secret text")
+	if _, err := svc.SoftDelete(ctx, c.ID, "mod"); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+
+	export := func(token string) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/comments/export?thread=t&format=ndjson", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 on export, got %d", res.StatusCode)
+		}
+		return string(body)
+	}
+
+	alice := signToken(t, map[string]any{"sub": "alice"})
+	for _, token := range []string{"", alice} {
+		if body := export(token); strings.Contains(body, "secret text") || !strings.Contains(body, model.DeletedText) {
+			t.Fatalf("expected the deleted text hidden, got %s", body)
+		}
+	}
+	admin := signToken(t, map[string]any{"sub": "mod", "role": "admin"})
+	if body := export(admin); !strings.Contains(body, "secret text") {
+		t.Fatalf("expected admins to export the stored text, got %s", body)
+	}
+}
+
+var testSecret = []byte("test-secret")
+
+func signToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	hdr, _ := json.Marshal(map[string]any{"alg": "HS256", "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	unsigned := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func doAuth(t *testing.T, method, url, token string, body any) *http.Response {
+	t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, url, rd)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	_ = res.Body.Close()
+	return res
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	svc := service.New(inm.New(), nil)
+	srv := httptest.NewServer(handler.New(svc, handler.WithJWTSecret(testSecret)).Routes())
+	defer srv.Close()
+
+	alice := signToken(t, map[string]any{"sub": "alice", "name": "Alice"})
+	bob := signToken(t, map[string]any{"sub": "bob"})
+	admin := signToken(t, map[string]any{"sub": "mod", "role": "admin"})
+	expired := signToken(t, map[string]any{"sub": "alice", "exp": 1})
+	root := map[string]any{"thread_key": "t", "parent_id": 0, "text": "root"}
+
+	if res := doAuth(t, http.MethodPost, srv.URL+"/comments", "", root); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodPost, srv.URL+"/comments", expired, root); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for expired token, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodPost, srv.URL+"/comments", alice+"x", root); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for bad signature, got %d", res.StatusCode)
+	}
+
+	b, _ := json.Marshal(root)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/comments", bytes.NewReader(b))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var created model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusCreated || created.Author.ID != "alice" || created.Author.Name != "Alice" {
+		t.Fatalf("unexpected create: %d %+v", res.StatusCode, created)
+	}
+
+	url := srv.URL + "/comments/" + strconv.FormatInt(created.ID, 10)
+	if res := doAuth(t, http.MethodGet, srv.URL+"/comments?thread=t", "", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected anonymous reads, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodPatch, url, bob, map[string]any{"text": "mine now"}); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodDelete, url, bob, nil); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 deleting as another user, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodPatch, url, alice, map[string]any{"text": "edited"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected author edit, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodDelete, url, admin, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected admin delete, got %d", res.StatusCode)
+	}
+
+	fsck := srv.URL + "/admin/fsck"
+	if res := doAuth(t, http.MethodGet, fsck, "", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for anonymous fsck, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodGet, fsck, bob, nil); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for fsck as a user, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodGet, fsck, admin, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected admin fsck, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminEndpointsWithoutAuth(t *testing.T) {
+	srv, _ := newServer()
+	defer srv.Close()
+
+	calls := []struct{ method, path, body string }{
+		{http.MethodGet, "/admin/fsck", ""},
+		{http.MethodPost, "/admin/fsck?repair=reroot", ""},
+		{http.MethodPost, "/comments/import?thread=copy", `[]`},
+	}
+	for _, c := range calls {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s %s: expected 403 with authentication off, got %d", c.method, c.path, res.StatusCode)
+		}
+	}
+}
+
+func TestVoteComment(t *testing.T) {
+	// anonymous voters are told apart by address, here the forwarded one
+	h := handler.New(service.New(inm.New(), nil), handler.WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8")))
+	srv := httptest.NewServer(h.Routes())
+	defer srv.Close()
+
+	b, _ := json.Marshal(map[string]any{"thread_key": "t", "parent_id": 0, "text": "root"})
+	res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("post create: %v", err)
+	}
+	var created model.Comment
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create: %v", err)
+	}
+	_ = res.Body.Close()
+
+	url := srv.URL + "/comments/" + strconv.FormatInt(created.ID, 10) + "/vote"
+	vote := func(client, body string) (int, model.Comment) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("X-Forwarded-For", client)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("vote: %v", err)
+		}
+		defer res.Body.Close()
+		var c model.Comment
+		_ = json.NewDecoder(res.Body).Decode(&c)
+		return res.StatusCode, c
+	}
+
+	if code, _ := vote("203.0.113.1", `{"value":5}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad value, got %d", code)
+	}
+	vote("203.0.113.1", `{"value":1}`)
+	code, voted := vote("203.0.113.2", `{"value":-1}`)
+	if code != http.StatusOK || voted.Upvotes != 1 || voted.Downvotes != 1 || voted.Score != 0 {
+		t.Fatalf("unexpected vote result: %d %+v", code, voted)
+	}
+	// a voter named in the body is ignored, the address has voted already
+	code, voted = vote("203.0.113.2", `{"value":-1,"voter":"someone-else"}`)
+	if code != http.StatusOK || voted.Upvotes != 1 || voted.Downvotes != 1 {
+		t.Fatalf("expected the repeated vote to replace the first, got %d %+v", code, voted)
+	}
+
+	res, err = http.Get(srv.URL + "/comments?thread=t&sort=best")
+	if err != nil {
+		t.Fatalf("get best: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for sort=best, got %d", res.StatusCode)
+	}
+}
+
+// readSSE collects the id, event and data lines of the next n events.
+func readSSE(t *testing.T, sc *bufio.Scanner, n int) []map[string]string {
+	t.Helper()
+	var out []map[string]string
+	cur := map[string]string{}
+	for len(out) < n && sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if cur["event"] != "" {
+				out = append(out, cur)
+			}
+			cur = map[string]string{}
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ": "); ok && k != "" {
+			cur[k] = v
+		}
+	}
+	if len(out) < n {
+		t.Fatalf("expected %d events, got %d: %v", n, len(out), sc.Err())
+	}
+	return out
+}
+
+func TestStreamComments(t *testing.T) {
+	bus := events.NewBus(16)
+	svc := service.New(inm.New(), nil, service.WithEvents(bus))
+	srv := httptest.NewServer(handler.New(svc, handler.WithEvents(bus), handler.WithHeartbeat(time.Hour)).Routes())
+	defer srv.Close()
+
+	create := func(thread string, parentID int64, text string) model.Comment {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"thread_key": thread, "parent_id": parentID, "text": text})
+		res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("post create: %v", err)
+		}
+		defer res.Body.Close()
+		var c model.Comment
+		if err := json.NewDecoder(res.Body).Decode(&c); err != nil {
+			t.Fatalf("decode create: %v", err)
+		}
+		return c
+	}
+	root := create("t", 0, "root")
+
+	open := func(query, lastID string) (*http.Response, *bufio.Scanner) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/comments/stream?"+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("open stream: %v", err)
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected stream response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		return res, bufio.NewScanner(res.Body)
+	}
+
+	res, sc := open("root="+strconv.FormatInt(root.ID, 10), "")
+	create("other", 0, "elsewhere")
+	child := create("", root.ID, "child")
+	doAuth(t, http.MethodPatch, srv.URL+"/comments/"+strconv.FormatInt(child.ID, 10), "", map[string]any{"text": "edited"})
+
+	got := readSSE(t, sc, 2)
+	_ = res.Body.Close()
+	if got[0]["event"] != "created" || got[1]["event"] != "edited" {
+		t.Fatalf("unexpected events: %v", got)
+	}
+	var e events.Event
+	if err := json.Unmarshal([]byte(got[1]["data"]), &e); err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	if e.Comment.ID != child.ID || e.Comment.Text != "edited" {
+		t.Fatalf("unexpected edited event: %+v", e)
+	}
+
+	// resuming after the created event replays the edit only
+	res, sc = open("thread=t", got[0]["id"])
+	defer res.Body.Close()
+	replayed := readSSE(t, sc, 1)
+	if replayed[0]["event"] != "edited" || replayed[0]["id"] != got[1]["id"] {
+		t.Fatalf("unexpected replay: %v", replayed)
+	}
+
+	bad, err := http.Get(srv.URL + "/comments/stream")
+	if err != nil {
+		t.Fatalf("get stream: %v", err)
+	}
+	_ = bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without root or thread, got %d", bad.StatusCode)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	srv, _ := newServer()
+	defer srv.Close()
+
+	cases := []struct {
+		name, method, path string
+		body               string
+		status             int
+		code, field        string
+	}{
+		{"text too long", http.MethodPost, "/comments", `{"thread_key":"t","text":"` + strings.Repeat("x", 2001) + `"}`, 400, "text_too_long", "text"},
+		{"empty text", http.MethodPost, "/comments", `{"thread_key":"t","text":" "}`, 400, "text_empty", "text"},
+		{"bad json", http.MethodPost, "/comments", `{`, 400, "bad_json", ""},
+		{"limit", http.MethodGet, "/comments?thread=t&limit=101", "", 400, "limit_out_of_range", "limit"},
+		{"sort", http.MethodGet, "/comments?thread=t&sort=random", "", 400, "invalid_sort", "sort"},
+		{"missing", http.MethodGet, "/comments/subtree?id=42", "", 404, "not_found", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			req, _ := http.NewRequest(tc.method, srv.URL+tc.path, body)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, res.StatusCode)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+				t.Fatalf("expected problem+json, got %q", ct)
+			}
+			var p struct {
+				Type   string `json:"type"`
+				Title  string `json:"title"`
+				Status int    `json:"status"`
+				Code   string `json:"code"`
+				Field  string `json:"field"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+				t.Fatalf("decode problem: %v", err)
+			}
+			if p.Status != tc.status || p.Code != tc.code || p.Field != tc.field || p.Type == "" || p.Title == "" {
+				t.Fatalf("unexpected problem %+v", p)
+			}
+		})
+	}
+}
+
+// openAPIDoc is just enough of OpenAPI and JSON Schema to check responses
+// against the served document.
+type openAPIDoc map[string]any
+
+func (d openAPIDoc) resolve(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	for {
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m
+		}
+		var cur any = map[string]any(d)
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			cur = cur.(map[string]any)[part]
+		}
+		m = cur.(map[string]any)
+	}
+}
+
+func (d openAPIDoc) validate(schema map[string]any, v any, at string) error {
+	schema = d.resolve(schema)
+
+	if alts, ok := schema["oneOf"].([]any); ok {
+		for _, alt := range alts {
+			if d.validate(d.resolve(alt), v, at) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: matches none of oneOf", at)
+	}
+
+	if typ, ok := schema["type"].(string); ok && !jsonTypeIs(v, typ) {
+		return fmt.Errorf("%s: expected %s, got %T", at, typ, v)
+	}
+	if c, ok := schema["const"]; ok && c != v {
+		return fmt.Errorf("%s: expected %v, got %v", at, c, v)
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for _, r := range asSlice(schema["required"]) {
+			if _, ok := v[r.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, r)
+			}
+		}
+		for k, val := range v {
+			ps, ok := props[k]
+			if !ok {
+				switch extra := schema["additionalProperties"].(type) {
+				case bool:
+					if !extra {
+						return fmt.Errorf("%s: undocumented property %s", at, k)
+					}
+					continue
+				case map[string]any:
+					ps = extra
+				default:
+					continue
+				}
+			}
+			if err := d.validate(ps.(map[string]any), val, at+"."+k); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, it := range v {
+				if err := d.validate(items, it, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func jsonTypeIs(v any, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	}
+	return false
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
+
+// operation finds the spec path template that matches a concrete path.
+func (d openAPIDoc) operation(method, path string) (string, map[string]any) {
+	for tmpl, item := range d["paths"].(map[string]any) {
+		want := strings.Split(tmpl, "/")
+		got := strings.Split(path, "/")
+		if len(want) != len(got) {
+			continue
+		}
+		ok := true
+		for i := range want {
+			if want[i] != got[i] && !strings.HasPrefix(want[i], "{") {
+				ok = false
+				break
+			}
+		}
+		if op, found := item.(map[string]any)[strings.ToLower(method)]; ok && found {
+			return method + " " + tmpl, op.(map[string]any)
+		}
+	}
+	return "", nil
+}
+
+func TestOpenAPIMatchesHandler(t *testing.T) {
+	repo := inm.New()
+	srv := httptest.NewServer(handler.New(service.New(repo, nil), handler.WithMetrics(prometheus.NewRegistry()), handler.WithAdminWithoutAuth()).Routes())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("get spec: %v", err)
+	}
+	var doc openAPIDoc
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode spec: %v", err)
+	}
+	_ = res.Body.Close()
+	if doc["openapi"] != "3.1.0" {
+		t.Fatalf("unexpected openapi version %v", doc["openapi"])
+	}
+
+	ctx := context.Background()
+	root, _ := repo.Create(ctx, "t", 0, model.Author{}, model.LanguageSimple, "root comment")
+	child, _ := repo.Create(ctx, "", root.ID, model.Author{ID: "alice", Name: "Alice"}, model.LanguageSimple, "child comment")
+	other, _ := repo.Create(ctx, "t", 0, model.Author{}, model.LanguageSimple, "other root")
+	victim, _ := repo.Create(ctx, "", other.ID, model.Author{}, model.LanguageSimple, "victim")
+
+	id := func(c model.Comment) string { return strconv.FormatInt(c.ID, 10) }
+	calls := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/comments?thread=t&sort=best", "", 200},
+		{"GET", "/comments?thread=t&limit=101", "", 400},
+		{"POST", "/comments", `{"thread_key":"t","text":"hello"}`, 201},
+		{"POST", "/comments", `{"thread_key":"t","text":""}`, 400},
+		{"POST", "/comments", `{"thread_key":"t","lang":"russian","text":"привет"}`, 201},
+		{"POST", "/comments", `{"thread_key":"t","lang":"klingon","text":"hello"}`, 400},
+		{"PATCH", "/comments/" + id(child), `{"text":"edited"}`, 200},
+		{"GET", "/comments/" + id(child) + "/revisions", "", 200},
+		{"POST", "/comments/" + id(child) + "/vote", `{"value":1}`, 200},
+		{"DELETE", "/comments/" + id(child) + "?mode=soft&by=mod", "", 200},
+		{"GET", "/comments/subtree?id=" + id(root), "", 200},
+		{"GET", "/comments/path?id=" + id(child), "", 200},
+		{"POST", "/comments/" + id(child) + "/restore", "", 200},
+		{"POST", "/comments/" + id(child) + "/move", `{"parent_id":` + id(other) + `}`, 200},
+		{"DELETE", "/comments/" + id(victim), "", 200},
+		{"GET", "/comments/subtree?id=999", "", 404},
+		{"GET", "/comments/search?q=comment", "", 200},
+		{"GET", "/comments/search?q=comment&lang=klingon", "", 400},
+		{"GET", "/comments/stream?thread=t", "", 501},
+		{"GET", "/comments/export?thread=t", "", 200},
+		{"GET", "/comments/export?root=" + id(root) + "&format=ndjson", "", 200},
+		{"GET", "/comments/export?thread=t&format=xml", "", 400},
+		{"POST", "/comments/import?thread=copy", `{"id":1,"parent_id":0,"thread_key":"t","text":"root","score":0,"upvotes":0,"downvotes":0,"created_at":"2024-01-02T03:04:05Z","children":[]}`, 201},
+		{"POST", "/comments/import?parent=999", `[]`, 404},
+		{"GET", "/admin/fsck", "", 200},
+		{"POST", "/admin/fsck?repair=reroot", "", 200},
+		{"POST", "/admin/fsck?repair=rm", "", 400},
+		{"GET", "/healthz", "", 200},
+		{"GET", "/livez", "", 200},
+		{"GET", "/readyz", "", 200},
+		{"GET", "/openapi.json", "", 200},
+		{"GET", "/metrics", "", 200},
+	}
+	// these serve files from ./web, which tests do not run next to
+	covered := map[string]bool{"GET /": true, "GET /static/{file}": true}
+
+	for _, c := range calls {
+		name, op := doc.operation(c.method, strings.SplitN(c.path, "?", 2)[0])
+		if op == nil {
+			t.Errorf("%s %s: not in spec", c.method, c.path)
+			continue
+		}
+		covered[name] = true
+
+		var body io.Reader
+		if c.body != "" {
+			body = strings.NewReader(c.body)
+		}
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, body)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		var got any
+		_ = json.NewDecoder(res.Body).Decode(&got)
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, res.StatusCode)
+			continue
+		}
+		spec := doc.resolve(op["responses"].(map[string]any)[strconv.Itoa(res.StatusCode)])
+		if spec == nil {
+			t.Errorf("%s: status %d not documented", name, res.StatusCode)
+			continue
+		}
+		content, _ := spec["content"].(map[string]any)
+		if len(content) == 0 {
+			continue
+		}
+		// a response may document several media types; the one sent must be among them
+		var ct string
+		for documented := range content {
+			if strings.HasPrefix(res.Header.Get("Content-Type"), documented) {
+				ct = documented
+			}
+		}
+		if ct == "" {
+			t.Errorf("%s: %s is not documented", name, res.Header.Get("Content-Type"))
+			continue
+		}
+		// NDJSON is checked through its first line, which got holds
+		if !strings.Contains(ct, "json") {
+			continue
+		}
+		schema := content[ct].(map[string]any)["schema"].(map[string]any)
+		if err := doc.validate(schema, got, name); err != nil {
+			t.Errorf("%d %v", res.StatusCode, err)
+		}
+	}
+
+	for tmpl, item := range doc["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			if method == "parameters" {
+				continue
+			}
+			if name := strings.ToUpper(method) + " " + tmpl; !covered[name] {
+				t.Errorf("%s is documented but not exercised", name)
+			}
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	repo := storage.Instrument(inm.New(), reg)
+	svc := service.New(repo, service.NewLRUCache(100), service.WithMetrics(reg))
+	srv := httptest.NewServer(handler.New(svc, handler.WithMetrics(reg)).Routes())
+	defer srv.Close()
+
+	b, _ := json.Marshal(map[string]any{"thread_key": "t", "text": "root"})
+	res, err := http.Post(srv.URL+"/comments", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var c model.Comment
+	_ = json.NewDecoder(res.Body).Decode(&c)
+	_ = res.Body.Close()
+
+	for range 2 {
+		res, err := http.Get(srv.URL + "/comments/subtree?id=" + strconv.FormatInt(c.ID, 10))
+		if err != nil {
+			t.Fatalf("subtree: %v", err)
+		}
+		_ = res.Body.Close()
+	}
+	doAuth(t, http.MethodPatch, srv.URL+"/comments/"+strconv.FormatInt(c.ID, 10), "", map[string]any{"text": ""})
+
+	res, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("metrics: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+
+	for _, want := range []string{
+		`commenttree_http_requests_total{method="POST",route="/comments",status="201"} 1`,
+		`commenttree_http_requests_total{method="GET",route="/comments/subtree",status="200"} 2`,
+		`commenttree_http_requests_total{method="PATCH",route="/comments/{id}",status="400"} 1`,
+		`commenttree_http_request_duration_seconds_count{method="GET",route="/comments/subtree",status="200"} 2`,
+		`commenttree_cache_lookups_total{kind="subtree",result="miss"} 1`,
+		`commenttree_cache_lookups_total{kind="subtree",result="hit"} 1`,
+		`commenttree_cache_invalidations_total{generation="root"} 1`,
+		`commenttree_repo_query_duration_seconds_count{method="GetSubtree",outcome="ok"} 1`,
+		`commenttree_repo_query_duration_seconds_count{method="Create",outcome="ok"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestTracingPropagatesTraceparent(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	repo := storage.Trace(inm.New(), tp)
+	svc := service.Trace(service.New(repo, nil), tp)
+	srv := httptest.NewServer(handler.New(svc, handler.WithTracing(tp)).Routes())
+	defer srv.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	b, _ := json.Marshal(map[string]any{"thread_key": "t", "text": "root"})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/comments", bytes.NewReader(b))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_ = res.Body.Close()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	httpSpan, svcSpan, repoSpan := spans["POST /comments"], spans["service.Create"], spans["repo.Create"]
+	if httpSpan == nil || svcSpan == nil || repoSpan == nil {
+		t.Fatalf("missing spans, got %v", slices.Collect(maps.Keys(spans)))
+	}
+	if got := httpSpan.SpanContext().TraceID().String(); got != traceID {
+		t.Fatalf("expected trace %s from traceparent, got %s", traceID, got)
+	}
+	if httpSpan.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("http span is not a child of the caller: %s", httpSpan.Parent().SpanID())
+	}
+	if svcSpan.Parent().SpanID() != httpSpan.SpanContext().SpanID() {
+		t.Fatalf("service span is not a child of the http span")
+	}
+	if repoSpan.Parent().SpanID() != svcSpan.SpanContext().SpanID() {
+		t.Fatalf("repo span is not a child of the service span")
+	}
+
+	var rows int64 = -1
+	for _, a := range repoSpan.Attributes() {
+		if a.Key == "rows" {
+			rows = a.Value.AsInt64()
+		}
+	}
+	if rows != 1 {
+		t.Fatalf("expected rows=1 on repo span, got %d", rows)
+	}
+}
+
+// brokenRepo fails subtree reads the way a lost database connection would.
+type brokenRepo struct {
+	*inm.Repo
+}
+
+func (brokenRepo) GetSubtree(context.Context, int64, model.Sort) (model.CommentNode, error) {
+	return model.CommentNode{}, errors.New("connection reset by peer")
+}
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	repo := brokenRepo{Repo: inm.New()}
+	root, _ := repo.Create(context.Background(), "t", 0, model.Author{}, model.LanguageSimple, "root")
+
+	var logs bytes.Buffer
+	srv := httptest.NewServer(handler.New(service.New(repo, nil), handler.WithLogger(zerolog.New(&logs))).Routes())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/comments/subtree?id="+strconv.FormatInt(root.ID, 10), nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subtree: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("X-Request-ID"); got != "req-42" {
+		t.Fatalf("expected request id to be echoed, got %q", got)
+	}
+
+	var lines []map[string]any
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var l map[string]any
+		if err := dec.Decode(&l); err != nil {
+			t.Fatalf("decode log: %v", err)
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected error and access lines, got %v", lines)
+	}
+	if l := lines[0]; l["level"] != "error" || l["request_id"] != "req-42" || l["error"] != "connection reset by peer" {
+		t.Fatalf("unexpected error line %v", l)
+	}
+	if l := lines[1]; l["request_id"] != "req-42" || l["route"] != "/comments/subtree" || l["status"] != float64(500) || l["bytes"] == float64(0) {
+		t.Fatalf("unexpected access line %v", l)
+	}
+
+	res, err = http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("healthz: %v", err)
+	}
+	_ = res.Body.Close()
+	if id := res.Header.Get("X-Request-ID"); len(id) != 32 {
+		t.Fatalf("expected a generated request id, got %q", id)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	var redisErr error
+	h := handler.New(service.New(inm.New(), nil),
+		handler.WithReadinessCheck("postgres", func(context.Context) error { return nil }),
+		handler.WithReadinessCheck("redis", func(context.Context) error { return redisErr }),
+	)
+	srv := httptest.NewServer(h.Routes())
+	defer srv.Close()
+
+	type readiness struct {
+		Status string `json:"status"`
+		Checks map[string]struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"checks"`
+	}
+	ready := func() (int, readiness) {
+		t.Helper()
+		res, err := http.Get(srv.URL + "/readyz")
+		if err != nil {
+			t.Fatalf("readyz: %v", err)
+		}
+		defer res.Body.Close()
+		var r readiness
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			t.Fatalf("decode readyz: %v", err)
+		}
+		return res.StatusCode, r
+	}
+
+	if code, r := ready(); code != http.StatusOK || r.Status != "ok" || len(r.Checks) != 2 {
+		t.Fatalf("expected ready, got %d %+v", code, r)
+	}
+
+	redisErr = errors.New("connection refused")
+	code, r := ready()
+	if code != http.StatusServiceUnavailable || r.Status != "unavailable" {
+		t.Fatalf("expected unavailable, got %d %+v", code, r)
+	}
+	if c := r.Checks["redis"]; c.Status != "error" || c.Error != "connection refused" || r.Checks["postgres"].Status != "ok" {
+		t.Fatalf("unexpected checks %+v", r.Checks)
+	}
+
+	redisErr = nil
+	h.Drain()
+	if code, r := ready(); code != http.StatusServiceUnavailable || r.Status != "draining" {
+		t.Fatalf("expected draining, got %d %+v", code, r)
+	}
+	res, err := http.Get(srv.URL + "/livez")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("expected livez to stay up while draining, got %v %v", res, err)
+	}
+	_ = res.Body.Close()
+}
+
+func TestRateLimit(t *testing.T) {
+	limits := map[string]ratelimit.Limit{"POST /comments": {Rate: 0.01, Burst: 2}}
+	h := handler.New(service.New(inm.New(), nil),
+		handler.WithJWTSecret(testSecret),
+		handler.WithRateLimit(ratelimit.NewMemory(), limits),
+	)
+	srv := httptest.NewServer(h.Routes())
+	defer srv.Close()
+
+	alice := signToken(t, map[string]any{"sub": "alice"})
+	bob := signToken(t, map[string]any{"sub": "bob"})
+	create := func(token string) *http.Response {
+		return doAuth(t, http.MethodPost, srv.URL+"/comments", token, map[string]any{"thread_key": "t", "text": "hi"})
+	}
+
+	for range 2 {
+		if res := create(alice); res.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201 within burst, got %d", res.StatusCode)
+		}
+	}
+	res := create(alice)
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", res.StatusCode)
+	}
+	if ra, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || ra < 1 || ra > 100 {
+		t.Fatalf("unexpected Retry-After %q", res.Header.Get("Retry-After"))
+	}
+	if res := create(bob); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected separate bucket per user, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodGet, srv.URL+"/comments?thread=t", alice, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected unlimited route to pass, got %d", res.StatusCode)
+	}
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	limits := map[string]ratelimit.Limit{"POST /comments": {Rate: 0.01, Burst: 1}}
+	newServer := func(opts ...handler.Option) *httptest.Server {
+		opts = append(opts, handler.WithRateLimit(ratelimit.NewMemory(), limits))
+		srv := httptest.NewServer(handler.New(service.New(inm.New(), nil), opts...).Routes())
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	create := func(srv *httptest.Server, forwarded string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/comments", strings.NewReader(`{"thread_key":"t","text":"hi"}`))
+		req.Header.Set("X-Forwarded-For", forwarded)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /comments: %v", err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	// the test client connects from 127.0.0.1
+	proxied := newServer(handler.WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")))
+	if code := create(proxied, "203.0.113.1"); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := create(proxied, "203.0.113.1, 10.0.0.7"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the client behind both proxies to be limited, got %d", code)
+	}
+	if code := create(proxied, "203.0.113.2, 203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("a hop sent by the client must not change its key, got %d", code)
+	}
+	if code := create(proxied, "203.0.113.2"); code != http.StatusCreated {
+		t.Fatalf("expected separate bucket per forwarded client, got %d", code)
+	}
+
+	direct := newServer()
+	if code := create(direct, "203.0.113.1"); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := create(direct, "203.0.113.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("X-Forwarded-For must be ignored without trusted proxies, got %d", code)
+	}
+}
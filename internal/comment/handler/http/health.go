@@ -0,0 +1,80 @@
+package http
+
+import (
+	"context"
+	stdhttp "net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds each dependency check so that a hung dependency
+// fails the probe instead of stalling it.
+const readinessTimeout = time.Second
+
+type readinessCheck struct {
+	name string
+	ping func(context.Context) error
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// WithReadinessCheck makes GET /readyz fail while ping fails. name labels the
+// dependency in the response.
+func WithReadinessCheck(name string, ping func(context.Context) error) Option {
+	return func(h *Handler) {
+		h.checks = append(h.checks, readinessCheck{name: name, ping: ping})
+	}
+}
+
+// Drain makes GET /readyz fail from now on, so that load balancers stop
+// sending traffic before the server shuts down.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// Livez reports that the process is up; it never looks at dependencies.
+func (h *Handler) Livez(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	writeJSON(w, stdhttp.StatusOK, map[string]any{"result": "ok"})
+}
+
+// Readyz pings every dependency concurrently and answers 503 if any of them
+// fails or the server is draining.
+func (h *Handler) Readyz(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	results := make(map[string]checkResult, len(h.checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.ping(ctx)
+			res := checkResult{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				res.Status, res.Error = "error", err.Error()
+			}
+			mu.Lock()
+			results[c.name] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	status, code := "ok", stdhttp.StatusOK
+	for _, res := range results {
+		if res.Status != "ok" {
+			status, code = "unavailable", stdhttp.StatusServiceUnavailable
+		}
+	}
+	if h.draining.Load() {
+		status, code = "draining", stdhttp.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": results})
+}
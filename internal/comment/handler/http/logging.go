@@ -0,0 +1,76 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	stdhttp "net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithLogger sets where access log lines and internal errors go. By default
+// nothing is logged.
+func WithLogger(l zerolog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = l
+	}
+}
+
+// RequestID returns the id of the request ctx belongs to, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequests gives every request an id, taken from X-Request-ID when the
+// client or a proxy sent a sane one, echoes it in the response and writes one
+// access log line when the request is done.
+func (h *Handler) logRequests(next stdhttp.Handler) stdhttp.Handler {
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rec := &statusRecorder{ResponseWriter: w, status: stdhttp.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		h.logger.Info().
+			Str("request_id", id).
+			Str("method", r.Method).
+			Str("route", routeLabel(r.URL.Path)).
+			Str("path", r.URL.Path).
+			Int("status", rec.status).
+			Dur("duration", time.Since(start)).
+			Int64("bytes", rec.bytes).
+			Msg("request")
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
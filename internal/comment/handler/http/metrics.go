@@ -0,0 +1,106 @@
+package http
+
+import (
+	stdhttp "net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type httpMetrics struct {
+	gatherer prometheus.Gatherer
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// WithMetrics counts and times requests per route and status, and serves
+// everything registered in reg at GET /metrics.
+func WithMetrics(reg *prometheus.Registry) Option {
+	return func(h *Handler) {
+		m := &httpMetrics{
+			gatherer: reg,
+			requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "commenttree_http_requests_total",
+				Help: "HTTP requests by route, method and status.",
+			}, []string{"route", "method", "status"}),
+			duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    "commenttree_http_request_duration_seconds",
+				Help:    "HTTP request latency by route, method and status.",
+				Buckets: prometheus.DefBuckets,
+			}, []string{"route", "method", "status"}),
+		}
+		reg.MustRegister(m.requests, m.duration)
+		h.metrics = m
+	}
+}
+
+func (h *Handler) instrument(next stdhttp.Handler) stdhttp.Handler {
+	if h.metrics == nil {
+		return next
+	}
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: stdhttp.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		labels := prometheus.Labels{
+			"route":  routeLabel(r.URL.Path),
+			"method": r.Method,
+			"status": strconv.Itoa(rec.status),
+		}
+		h.metrics.requests.With(labels).Inc()
+		h.metrics.duration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeLabel maps a request path to its route template, so that ids do not
+// end up as label values.
+func routeLabel(p string) string {
+	switch p {
+	case "/", "/comments", "/comments/search", "/comments/path", "/comments/subtree",
+		"/comments/stream", "/comments/export", "/comments/import", "/admin/fsck", "/healthz", "/livez", "/readyz", "/openapi.json", "/metrics":
+		return p
+	}
+	if strings.HasPrefix(p, "/static/") {
+		return "/static/{file}"
+	}
+	if strings.HasPrefix(p, "/comments/") {
+		switch _, action := commentPath(p); action {
+		case "":
+			return "/comments/{id}"
+		case "revisions", "restore", "move", "vote":
+			return "/comments/{id}/" + action
+		}
+	}
+	return "other"
+}
+
+// statusRecorder remembers the response status and size. Unwrap keeps
+// flushing and deadlines reachable through http.ResponseController.
+type statusRecorder struct {
+	stdhttp.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() stdhttp.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (h *Handler) serveMetrics() stdhttp.Handler {
+	return promhttp.HandlerFor(h.metrics.gatherer, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,22 @@
+package http
+
+import (
+	_ "embed"
+	stdhttp "net/http"
+)
+
+// openAPISpec describes every route in Routes. handler_test checks real
+// responses against it, so a change to either must update the other.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI serves the API description.
+func (h *Handler) OpenAPI(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	if r.Method != stdhttp.MethodGet {
+		stdhttp.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(openAPISpec)
+}
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	stdhttp "net/http"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+)
+
+// problem is an RFC 7807 error body. Code and Field are extension members a
+// client can switch on instead of parsing the human-readable detail.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	Field  string `json:"field,omitempty"`
+}
+
+// Codes of errors detected by the handler itself rather than the service.
+const (
+	codeBadJSON           = "bad_json"
+	codeInvalidInput      = "invalid_input"
+	codeNotFound          = "not_found"
+	codeForbidden         = "forbidden"
+	codeUnauthorized      = "unauthorized"
+	codeInternal          = "internal"
+	codeStreamingDisabled = "streaming_disabled"
+	codeRateLimited       = "rate_limited"
+)
+
+// writeError maps a service error to its problem response. Errors the service
+// did not classify are reported as internal without leaking their text; they
+// are logged with the request id instead.
+func (h *Handler) writeError(w stdhttp.ResponseWriter, r *stdhttp.Request, err error) {
+	var ve *service.ValidationError
+	switch {
+	case errors.As(err, &ve):
+		writeProblem(w, stdhttp.StatusBadRequest, ve.Code, ve.Field, ve.Message)
+	case errors.Is(err, service.ErrInvalidInput):
+		writeProblem(w, stdhttp.StatusBadRequest, codeInvalidInput, "", "")
+	case errors.Is(err, service.ErrNotFound):
+		writeProblem(w, stdhttp.StatusNotFound, codeNotFound, "", "")
+	case errors.Is(err, service.ErrForbidden):
+		writeProblem(w, stdhttp.StatusForbidden, codeForbidden, "", "only the author or an admin may do this")
+	default:
+		h.logger.Error().Err(err).
+			Str("request_id", RequestID(r.Context())).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Msg("internal error")
+		writeProblem(w, stdhttp.StatusInternalServerError, codeInternal, "", "")
+	}
+}
+
+// badRequest reports a malformed parameter caught before the service is called.
+func badRequest(w stdhttp.ResponseWriter, field, code, detail string) {
+	writeProblem(w, stdhttp.StatusBadRequest, code, field, detail)
+}
+
+func writeProblem(w stdhttp.ResponseWriter, status int, code, field, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  stdhttp.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Field:  field,
+	})
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"math"
+	"net"
+	stdhttp "net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/ratelimit"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+)
+
+type rateLimits struct {
+	limiter ratelimit.Limiter
+	routes  map[string]ratelimit.Limit
+}
+
+// WithRateLimit throttles each client per route. Keys of limits are routes as
+// in metrics, e.g. "POST /comments" or "GET /comments/search"; other routes
+// are not limited. Clients are told apart by authenticated user, otherwise by
+// IP address, see WithTrustedProxies.
+func WithRateLimit(limiter ratelimit.Limiter, limits map[string]ratelimit.Limit) Option {
+	return func(h *Handler) {
+		h.limits = &rateLimits{limiter: limiter, routes: limits}
+	}
+}
+
+// WithTrustedProxies lets requests relayed by proxies, e.g. the load balancer,
+// name their client in X-Forwarded-For. Hops are read from the right and
+// those added by trusted proxies skipped, so a client cannot choose its own
+// address by sending the header. Without proxies the header is ignored.
+func WithTrustedProxies(proxies ...netip.Prefix) Option {
+	return func(h *Handler) {
+		h.proxies = proxies
+	}
+}
+
+func (h *Handler) rateLimit(next stdhttp.Handler) stdhttp.Handler {
+	if h.limits == nil {
+		return next
+	}
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		route := r.Method + " " + routeLabel(r.URL.Path)
+		l, ok := h.limits.routes[route]
+		if !ok || !l.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, wait, err := h.limits.limiter.Allow(r.Context(), route+":"+h.clientKey(r), l)
+		if err != nil {
+			// a broken limiter must not take the API down with it
+			h.logger.Warn().Err(err).Str("request_id", RequestID(r.Context())).Msg("rate limiter failed")
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+			writeProblem(w, stdhttp.StatusTooManyRequests, codeRateLimited, "", "too many requests, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) clientKey(r *stdhttp.Request) string {
+	if a, ok := service.ActorFrom(r.Context()); ok {
+		return "user:" + a.ID
+	}
+	return "ip:" + h.clientIP(r)
+}
+
+// clientIP returns the remote address or, for a request from a trusted proxy,
+// the rightmost X-Forwarded-For hop that no trusted proxy added.
+func (h *Handler) clientIP(r *stdhttp.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+	if !h.trustedProxy(addr) {
+		return addr.String()
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// past a malformed hop nothing is trustworthy
+			break
+		}
+		addr = hop.Unmap()
+		if !h.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func (h *Handler) trustedProxy(addr netip.Addr) bool {
+	for _, p := range h.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
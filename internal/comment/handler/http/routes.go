@@ -19,18 +19,41 @@ func (h *Handler) Routes() stdhttp.Handler {
 		}
 	})
 
-	// /comments/{id} for operations like DELETE
+	// /comments/{id} handles DELETE and PATCH, /comments/{id}/{action} the per-comment sub-resources
 	mux.HandleFunc("/comments/", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
-		if r.Method == stdhttp.MethodDelete {
+		_, action := commentPath(r.URL.Path)
+		switch {
+		case action == "" && r.Method == stdhttp.MethodDelete:
 			h.DeleteComment(w, r)
-			return
+		case action == "" && r.Method == stdhttp.MethodPatch:
+			h.UpdateComment(w, r)
+		case action == "revisions" && r.Method == stdhttp.MethodGet:
+			h.GetRevisions(w, r)
+		case action == "restore" && r.Method == stdhttp.MethodPost:
+			h.RestoreComment(w, r)
+		case action == "move" && r.Method == stdhttp.MethodPost:
+			h.MoveComment(w, r)
+		case action == "vote" && r.Method == stdhttp.MethodPost:
+			h.VoteComment(w, r)
+		default:
+			stdhttp.NotFound(w, r)
 		}
-		stdhttp.NotFound(w, r)
 	})
 
 	mux.HandleFunc("/comments/search", h.SearchComments)
 	mux.HandleFunc("/comments/path", h.GetPath)
 	mux.HandleFunc("/comments/subtree", h.GetSubtree)
+	mux.HandleFunc("/comments/stream", h.StreamComments)
+	mux.HandleFunc("/comments/export", h.ExportComments)
+	mux.HandleFunc("/comments/import", h.ImportComments)
+	mux.HandleFunc("/admin/fsck", h.CheckIntegrity)
+
+	mux.HandleFunc("/livez", h.Livez)
+	mux.HandleFunc("/readyz", h.Readyz)
+	mux.HandleFunc("/openapi.json", h.OpenAPI)
+	if h.metrics != nil {
+		mux.Handle("/metrics", h.serveMetrics())
+	}
 
 	mux.HandleFunc("/healthz", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -48,5 +71,5 @@ func (h *Handler) Routes() stdhttp.Handler {
 
 	mux.Handle("/static/", stdhttp.StripPrefix("/static/", stdhttp.FileServer(stdhttp.Dir("./web"))))
 
-	return mux
+	return h.logRequests(h.instrument(h.trace(h.authenticate(h.rateLimit(mux)))))
 }
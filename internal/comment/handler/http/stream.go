@@ -0,0 +1,126 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	stdhttp "net/http"
+	"strconv"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/events"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+)
+
+// defaultHeartbeat keeps idle streams alive through proxies that close
+// connections after a minute of silence.
+const defaultHeartbeat = 15 * time.Second
+
+// WithEvents serves GET /comments/stream from bus.
+func WithEvents(bus *events.Bus) Option {
+	return func(h *Handler) {
+		h.events = bus
+	}
+}
+
+// WithHeartbeat sets how often an idle stream gets a keep-alive comment.
+func WithHeartbeat(d time.Duration) Option {
+	return func(h *Handler) {
+		h.heartbeat = d
+	}
+}
+
+// StreamComments sends comment events of a subtree (root) or a whole thread
+// as Server-Sent Events. A client that reconnects with Last-Event-ID first
+// gets what it missed; if that is no longer buffered it gets a "reset" event
+// and should reload the tree.
+func (h *Handler) StreamComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	if r.Method != stdhttp.MethodGet {
+		stdhttp.NotFound(w, r)
+		return
+	}
+	if h.events == nil {
+		writeProblem(w, stdhttp.StatusNotImplemented, codeStreamingDisabled, "", "")
+		return
+	}
+
+	q := r.URL.Query()
+	thread := q.Get("thread")
+	root := int64(0)
+	if v := q.Get("root"); v != "" {
+		parsed, err := parseInt64(v)
+		if err != nil || parsed <= 0 {
+			badRequest(w, "root", service.CodeInvalidID, "must be a positive integer")
+			return
+		}
+		root = parsed
+	}
+	if root == 0 && thread == "" {
+		badRequest(w, "thread", service.CodeThreadRequired, "root or thread is required")
+		return
+	}
+
+	lastID := uint64(0)
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			badRequest(w, "Last-Event-ID", codeInvalidInput, "must be an event id")
+			return
+		}
+		lastID = parsed
+	}
+
+	rc := stdhttp.NewResponseController(w)
+	// the server write timeout is meant for ordinary responses, not streams
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	sub, replay, complete := h.events.Subscribe(lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(stdhttp.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range replay {
+		if e.Match(root, thread) {
+			writeEvent(w, e)
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e, ok := <-sub.C():
+			if !ok {
+				// fell behind; the client reconnects and resumes from the buffer
+				return
+			}
+			if !e.Match(root, thread) {
+				continue
+			}
+			writeEvent(w, e)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w stdhttp.ResponseWriter, e events.Event) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	stdhttp "net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type httpTracing struct {
+	tp         trace.TracerProvider
+	propagator propagation.TextMapPropagator
+}
+
+// WithTracing starts a server span per request, named after its route. A W3C
+// traceparent header on the request makes the span a child of the caller's.
+func WithTracing(tp trace.TracerProvider) Option {
+	return func(h *Handler) {
+		h.tracing = &httpTracing{
+			tp:         tp,
+			propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		}
+	}
+}
+
+func (h *Handler) trace(next stdhttp.Handler) stdhttp.Handler {
+	if h.tracing == nil {
+		return next
+	}
+	routed := stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.route", routeLabel(r.URL.Path)))
+		next.ServeHTTP(w, r)
+	})
+	traced := otelhttp.NewHandler(routed, "http",
+		otelhttp.WithTracerProvider(h.tracing.tp),
+		otelhttp.WithPropagators(h.tracing.propagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *stdhttp.Request) string {
+			return r.Method + " " + routeLabel(r.URL.Path)
+		}),
+	)
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		// event streams stay untraced: a span lasting minutes tells nothing,
+		// and the otelhttp writer hides the write deadline the stream clears
+		if r.URL.Path == "/comments/stream" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		traced.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package http
+
+import (
+	stdhttp "net/http"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/service"
+)
+
+// ExportComments streams a subtree (?root=) or a whole thread (?thread=) as
+// nested JSON or NDJSON (?format=).
+func (h *Handler) ExportComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	if r.Method != stdhttp.MethodGet {
+		stdhttp.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+
+	rootID := int64(0)
+	if v := q.Get("root"); v != "" {
+		parsed, err := parseInt64(v)
+		if err != nil || parsed <= 0 {
+			badRequest(w, "root", service.CodeInvalidID, "must be a positive integer")
+			return
+		}
+		rootID = parsed
+	}
+	format := transferFormat(q.Get("format"))
+
+	ctx := r.Context()
+	if _, ok := service.ActorFrom(ctx); !ok {
+		// an anonymous export is the public view, not trusted code
+		ctx = service.WithActor(ctx, service.Actor{})
+	}
+
+	ew := &exportWriter{w: w, format: format}
+	if err := h.svc.Export(ctx, q.Get("thread"), rootID, format, ew); err != nil {
+		if !ew.started {
+			h.writeError(w, r, err)
+			return
+		}
+		// the status is out already; a cut-off body is all the client can see
+		h.logger.Error().Err(err).
+			Str("request_id", RequestID(r.Context())).
+			Msg("export failed midway")
+	}
+	if !ew.started {
+		// nothing to export still needs a status
+		_, _ = ew.Write(nil)
+	}
+}
+
+// ImportComments recreates an export under ?parent= or in ?thread=.
+func (h *Handler) ImportComments(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+	if r.Method != stdhttp.MethodPost {
+		stdhttp.NotFound(w, r)
+		return
+	}
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+
+	parentID := int64(0)
+	if v := q.Get("parent"); v != "" {
+		parsed, err := parseInt64(v)
+		if err != nil {
+			badRequest(w, "parent", service.CodeInvalidParent, "must be an integer")
+			return
+		}
+		parentID = parsed
+	}
+
+	res, err := h.svc.Import(r.Context(), q.Get("thread"), parentID, transferFormat(q.Get("format")), r.Body)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, stdhttp.StatusCreated, res)
+}
+
+func transferFormat(v string) service.Format {
+	if v == "" {
+		return service.FormatJSON
+	}
+	return service.Format(v)
+}
+
+// exportWriter sends the success headers with the first byte, so an export
+// that fails before writing anything can still answer with a problem.
+type exportWriter struct {
+	w       stdhttp.ResponseWriter
+	format  service.Format
+	started bool
+}
+
+func (e *exportWriter) Write(b []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		ct, name := "application/json; charset=utf-8", "comments.json"
+		if e.format == service.FormatNDJSON {
+			ct, name = "application/x-ndjson", "comments.ndjson"
+		}
+		e.w.Header().Set("Content-Type", ct)
+		e.w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		e.w.WriteHeader(stdhttp.StatusOK)
+	}
+	return e.w.Write(b)
+}
@@ -0,0 +1,8 @@
+package model
+
+// Author identifies who wrote a comment. Comments created without
+// authentication have a zero Author.
+type Author struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
@@ -3,12 +3,24 @@ package model
 import "time"
 
 type Comment struct {
-	ID        int64     `json:"id"`
-	ParentID  int64     `json:"parent_id"`
-	Text      string    `json:"text"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int64      `json:"id"`
+	ParentID  int64      `json:"parent_id"`
+	ThreadKey string     `json:"thread_key"`
+	Author    Author     `json:"author,omitzero"`
+	Text      string     `json:"text"`
+	Lang      Language   `json:"lang"`
+	Score     int        `json:"score"`
+	Upvotes   int        `json:"upvotes"`
+	Downvotes int        `json:"downvotes"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
 }
 
+// DeletedText replaces the text of soft-deleted comments in rendered trees.
+const DeletedText = "[deleted]"
+
 type CommentNode struct {
 	Comment
 	Children []CommentNode `json:"children"`
@@ -19,4 +31,7 @@ type TreePage struct {
 	Page  int           `json:"page"`
 	Limit int           `json:"limit"`
 	Total int           `json:"total"`
+
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
 }
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is an opaque keyset position: the sort key of the item it points at
+// and the direction to walk from it. Tree pages key on (created_at, id),
+// rank-sorted search on (rank, id).
+type Cursor struct {
+	Sort      Sort      `json:"s"`
+	CreatedAt time.Time `json:"t"`
+	Rank      float64   `json:"r,omitempty"`
+	ID        int64     `json:"id"`
+	Backward  bool      `json:"b,omitempty"`
+}
+
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID <= 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,56 @@
+package model
+
+// TreeLink is how a comment is linked into its tree as stored, taken at face
+// value for integrity checks. Path lists the ids from the top-level comment
+// down, dot-separated; it is empty and Depth -1 for storages that keep
+// neither.
+type TreeLink struct {
+	ID        int64
+	ParentID  int64
+	ThreadKey string
+	Path      string
+	Depth     int
+}
+
+// IntegrityReport lists what an integrity check found and, after a repair,
+// what was changed.
+type IntegrityReport struct {
+	Checked int `json:"checked"`
+	// Orphans are comments whose parent does not exist.
+	Orphans []int64 `json:"orphans"`
+	// Cycles are loops of parent links, each starting at its smallest id.
+	Cycles [][]int64 `json:"cycles"`
+	// Unreachable counts the comments no tree query returns: orphans, cycle
+	// members and everything below them.
+	Unreachable int `json:"unreachable"`
+	// ThreadMismatches are replies whose thread differs from their parent's.
+	ThreadMismatches []int64        `json:"thread_mismatches"`
+	DepthAnomalies   []DepthAnomaly `json:"depth_anomalies"`
+
+	Repair *IntegrityRepair `json:"repair,omitempty"`
+}
+
+// OK reports whether nothing is wrong.
+func (r IntegrityReport) OK() bool {
+	return len(r.Orphans) == 0 && len(r.Cycles) == 0 && len(r.ThreadMismatches) == 0 && len(r.DepthAnomalies) == 0
+}
+
+// DepthAnomaly is a comment whose stored path or depth does not match its
+// chain of parents.
+type DepthAnomaly struct {
+	ID          int64  `json:"id"`
+	StoredDepth int    `json:"stored_depth"`
+	ActualDepth int    `json:"actual_depth"`
+	StoredPath  string `json:"stored_path,omitempty"`
+	ActualPath  string `json:"actual_path,omitempty"`
+}
+
+type IntegrityRepair struct {
+	Strategy string `json:"strategy"`
+	// Reattached counts orphans and cycle members given a new parent.
+	Reattached int `json:"reattached"`
+	// QuarantineID is the comment they were moved under, 0 when rerooted.
+	QuarantineID int64 `json:"quarantine_id,omitempty"`
+	// Rebuilt counts comments whose thread, path or depth was recomputed.
+	Rebuilt int `json:"rebuilt"`
+}
@@ -0,0 +1,24 @@
+package model
+
+import "slices"
+
+// Language is a Postgres text search configuration. It decides how the text
+// of a comment and a search query are split into words and stemmed.
+type Language string
+
+// LanguageSimple only lowercases words, so no language gets stemming.
+const LanguageSimple Language = "simple"
+
+// Languages are the configurations comments may be indexed with: simple and
+// the stemmers every supported Postgres version ships.
+var Languages = []Language{
+	LanguageSimple,
+	"danish", "dutch", "english", "finnish", "french", "german", "hungarian",
+	"italian", "norwegian", "portuguese", "romanian", "russian", "spanish",
+	"swedish", "turkish",
+}
+
+// Valid reports whether l is one of Languages.
+func (l Language) Valid() bool {
+	return slices.Contains(Languages, l)
+}
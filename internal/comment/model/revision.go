@@ -0,0 +1,10 @@
+package model
+
+import "time"
+
+type CommentRevision struct {
+	ID        int64     `json:"id"`
+	CommentID int64     `json:"comment_id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
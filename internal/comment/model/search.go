@@ -5,6 +5,8 @@ import "time"
 type SearchItem struct {
 	ID        int64     `json:"id"`
 	ParentID  int64     `json:"parent_id"`
+	ThreadKey string    `json:"thread_key"`
+	Author    Author    `json:"author,omitzero"`
 	Snippet   string    `json:"snippet"`
 	Rank      float64   `json:"rank"`
 	CreatedAt time.Time `json:"created_at"`
@@ -15,4 +17,7 @@ type SearchPage struct {
 	Page  int          `json:"page"`
 	Limit int          `json:"limit"`
 	Total int          `json:"total"`
+
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
 }
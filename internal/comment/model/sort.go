@@ -6,4 +6,40 @@ const (
 	SortCreatedAtAsc  Sort = "created_at_asc"
 	SortCreatedAtDesc Sort = "created_at_desc"
 	SortRankDesc      Sort = "rank_desc"
+	SortScoreDesc     Sort = "score_desc"
+	SortControversial Sort = "controversial"
+	SortBest          Sort = "best"
 )
+
+// ByVotes reports whether s orders by vote counts. Those keys change while a
+// reader pages, so such sorts are paged by offset only, never by cursor.
+func (s Sort) ByVotes() bool {
+	return s == SortScoreDesc || s == SortControversial || s == SortBest
+}
+
+// Less orders comments for tree sorts. Vote-based sorts put the highest key
+// first and fall back to newest first.
+func (s Sort) Less(a, b Comment) bool {
+	var ka, kb float64
+	switch s {
+	case SortScoreDesc:
+		ka, kb = float64(a.Score), float64(b.Score)
+	case SortControversial:
+		ka, kb = Controversy(a.Upvotes, a.Downvotes), Controversy(b.Upvotes, b.Downvotes)
+	case SortBest:
+		ka, kb = Wilson(a.Upvotes, a.Downvotes), Wilson(b.Upvotes, b.Downvotes)
+	}
+	if ka != kb {
+		return ka > kb
+	}
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		if s == SortCreatedAtAsc {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	if s == SortCreatedAtAsc {
+		return a.ID < b.ID
+	}
+	return a.ID > b.ID
+}
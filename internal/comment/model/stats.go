@@ -0,0 +1,16 @@
+package model
+
+// Stats summarizes what is stored.
+type Stats struct {
+	Comments int `json:"comments"`
+	Deleted  int `json:"deleted"`
+	Threads  int `json:"threads"`
+	// MaxDepth is the deepest reply level; top-level comments are depth 0.
+	MaxDepth   int           `json:"max_depth"`
+	TopThreads []ThreadStats `json:"top_threads"`
+}
+
+type ThreadStats struct {
+	ThreadKey string `json:"thread_key"`
+	Comments  int    `json:"comments"`
+}
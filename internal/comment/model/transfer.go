@@ -0,0 +1,10 @@
+package model
+
+// ImportResult reports what an import created.
+type ImportResult struct {
+	Imported  int    `json:"imported"`
+	ThreadKey string `json:"thread_key"`
+	// Roots are the new ids of the imported comments that have no imported
+	// parent, in input order.
+	Roots []int64 `json:"roots"`
+}
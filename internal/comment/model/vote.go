@@ -0,0 +1,33 @@
+package model
+
+import "math"
+
+// wilsonZ is the normal quantile for a 95% confidence interval.
+const wilsonZ = 1.96
+
+// Wilson is the lower bound of the Wilson score interval for the share of
+// upvotes: a comment with few votes ranks below one that is as well liked by
+// many. The migrations define comment_wilson with the same formula.
+func Wilson(ups, downs int) float64 {
+	n := float64(ups + downs)
+	if n == 0 {
+		return 0
+	}
+	z2 := wilsonZ * wilsonZ
+	p := float64(ups) / n
+	return (p + z2/(2*n) - wilsonZ*math.Sqrt(float64(ups)*float64(downs)/n+z2/4)/n) / (1 + z2/n)
+}
+
+// Controversy grows with the number of votes and with how evenly they split,
+// and is zero unless a comment has votes both ways. The migrations define
+// comment_controversy with the same formula.
+func Controversy(ups, downs int) float64 {
+	if ups <= 0 || downs <= 0 {
+		return 0
+	}
+	balance := float64(downs) / float64(ups)
+	if ups < downs {
+		balance = float64(ups) / float64(downs)
+	}
+	return math.Pow(float64(ups+downs), balance)
+}
@@ -0,0 +1,63 @@
+// Package ratelimit throttles clients with token buckets.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket: Burst requests at once, refilled at Rate per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limiter takes one token from the bucket of key. When the bucket is empty it
+// reports how long until the next token arrives.
+type Limiter interface {
+	Allow(ctx context.Context, key string, l Limit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// ParseLimit reads "N/period", e.g. "10/m" or "100/30s": up to N requests in a
+// burst, refilled evenly over period. "off" or "0" disables the limit and
+// returns a zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q: expected N/period", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid count", s)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid period", s)
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// Enabled reports whether l limits anything.
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// refill returns the tokens in a bucket that held tokens elapsed ago.
+func refill(l Limit, tokens float64, elapsed time.Duration) float64 {
+	return min(float64(l.Burst), tokens+elapsed.Seconds()*l.Rate)
+}
+
+// waitFor returns how long a bucket holding tokens (< 1) needs to refill one.
+func waitFor(l Limit, tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseLimit(t *testing.T) {
+	cases := map[string]Limit{
+		"10/m":    {Rate: 10.0 / 60, Burst: 10},
+		"100/30s": {Rate: 100.0 / 30, Burst: 100},
+		"1/h":     {Rate: 1.0 / 3600, Burst: 1},
+		"off":     {},
+	}
+	for in, want := range cases {
+		got, err := ParseLimit(in)
+		if err != nil || got != want {
+			t.Errorf("ParseLimit(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"10", "x/m", "-1/m", "10/0s", "10/forever"} {
+		if _, err := ParseLimit(in); err == nil {
+			t.Errorf("ParseLimit(%q): expected error", in)
+		}
+	}
+}
+
+func TestLimiters(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	mem := NewMemory()
+	mem.now = clock
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	red := NewRedis(rdb)
+	// the script reads the clock of the Redis server
+	mr.SetTime(now)
+
+	for name, lim := range map[string]Limiter{"memory": mem, "redis": red} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			l := Limit{Rate: 1, Burst: 2}
+			allow := func(key string) (bool, time.Duration) {
+				t.Helper()
+				ok, wait, err := lim.Allow(ctx, key, l)
+				if err != nil {
+					t.Fatalf("Allow: %v", err)
+				}
+				return ok, wait
+			}
+
+			for i := range 2 {
+				if ok, _ := allow(name + ":a"); !ok {
+					t.Fatalf("request %d within burst was refused", i)
+				}
+			}
+			ok, wait := allow(name + ":a")
+			if ok || wait <= 0 || wait > time.Second {
+				t.Fatalf("expected refusal with wait up to 1s, got %v %v", ok, wait)
+			}
+			if ok, _ := allow(name + ":b"); !ok {
+				t.Fatalf("another key must have its own bucket")
+			}
+
+			now = now.Add(time.Second)
+			mr.SetTime(now)
+			if ok, _ := allow(name + ":a"); !ok {
+				t.Fatalf("expected a token after refill")
+			}
+			if ok, _ := allow(name + ":a"); ok {
+				t.Fatalf("expected only one token after a second")
+			}
+		})
+	}
+}
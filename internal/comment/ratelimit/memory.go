@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the size at which Memory starts dropping full buckets, which
+// behave exactly like missing ones.
+const maxBuckets = 100_000
+
+// Memory keeps buckets in process. Each replica limits on its own, so the
+// effective limit grows with the number of replicas.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, l Limit) (bool, time.Duration, error) {
+	_ = ctx
+	if !l.Enabled() {
+		return true, 0, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxBuckets {
+			m.sweepLocked(now)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now, limit: l}
+		m.buckets[key] = b
+	}
+	b.tokens = refill(l, b.tokens, now.Sub(b.last))
+	b.last, b.limit = now, l
+
+	if b.tokens < 1 {
+		return false, waitFor(l, b.tokens), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+func (m *Memory) sweepLocked(now time.Time) {
+	for k, b := range m.buckets {
+		if refill(b.limit, b.tokens, now.Sub(b.last)) >= float64(b.limit.Burst) {
+			delete(m.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// Actor is the authenticated caller of a service method.
+type Actor struct {
+	ID    string
+	Name  string
+	Admin bool
+}
+
+type actorKey struct{}
+
+// WithActor attaches the authenticated caller to ctx.
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// ActorFrom returns the caller attached to ctx. Requests without an actor come
+// from trusted code (background jobs, or the API with auth disabled).
+func ActorFrom(ctx context.Context) (Actor, bool) {
+	a, ok := ctx.Value(actorKey{}).(Actor)
+	return a, ok
+}
+
+// authorize loads comment id and checks that the caller may change it: only
+// its author or an admin can.
+func (s *commentService) authorize(ctx context.Context, id int64) (model.Comment, error) {
+	c, err := s.repo.Get(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Comment{}, ErrNotFound
+	}
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	a, ok := ActorFrom(ctx)
+	if !ok || a.Admin {
+		return c, nil
+	}
+	if a.ID == "" || a.ID != c.Author.ID {
+		return model.Comment{}, ErrForbidden
+	}
+	return c, nil
+}
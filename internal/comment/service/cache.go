@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cached pages are never deleted. Every key embeds generation counters and a
+// write bumps the counters that cover it, which makes the old entries
+// unreachable until their TTL runs out. Three generations exist:
+//
+//   - global: bumped by writes that may touch any tree (purge);
+//   - thread: the top-level pages of a thread, which include whole trees;
+//   - root: everything below a top-level comment, i.e. reply pages and
+//     subtrees inside its tree.
+//
+// Any change in a tree bumps its root and its thread, so invalidation costs
+// two counter increments whatever the tree size.
+const defaultCacheTTL = 2 * time.Minute
+
+// refreshTimeout bounds a shared load, which runs detached from the requests
+// waiting on it and so has no deadline to inherit.
+const refreshTimeout = 10 * time.Second
+
+const genGlobalKey = "gen:global"
+
+func genThreadKey(threadKey string) string {
+	return "gen:thread:" + threadKey
+}
+
+func genRootKey(root int64) string {
+	return fmt.Sprintf("gen:root:%d", root)
+}
+
+// Cache stores rendered pages. Besides plain entries it keeps the generation
+// counters that page keys embed.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	// Generations returns the counters of keys, 0 for counters never bumped.
+	Generations(ctx context.Context, keys ...string) ([]int64, error)
+	Bump(ctx context.Context, keys ...string) error
+}
+
+// NoopCache caches nothing.
+type NoopCache struct{}
+
+func (NoopCache) Get(context.Context, string) ([]byte, bool)         { return nil, false }
+func (NoopCache) Set(context.Context, string, []byte, time.Duration) {}
+func (NoopCache) Generations(context.Context, ...string) ([]int64, error) {
+	return nil, errCacheDisabled
+}
+func (NoopCache) Bump(context.Context, ...string) error { return nil }
+
+var errCacheDisabled = errors.New("cache disabled")
+
+// invalidateBranch makes stale the top level of the thread and the tree that
+// path (root first) lies in. Without a path the tree is unknown and the whole
+// cache goes.
+func (s *commentService) invalidateBranch(ctx context.Context, threadKey string, path []int64) {
+	if len(path) == 0 {
+		s.invalidateAll(ctx)
+		return
+	}
+	_ = s.cache.Bump(ctx, genThreadKey(threadKey), genRootKey(path[0]))
+	s.metrics.invalidated("thread", "root")
+}
+
+func (s *commentService) invalidateAll(ctx context.Context) {
+	_ = s.cache.Bump(ctx, genGlobalKey)
+	s.metrics.invalidated("global")
+}
+
+// treeRoot checks that comment id exists and returns the top-level comment of
+// its tree.
+func (s *commentService) treeRoot(ctx context.Context, id int64) (int64, error) {
+	path, err := s.repo.GetPath(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return path[0].ID, nil
+}
+
+// treeCacheKey returns the key of a tree page, or "" when the cache is off.
+// Top-level pages live under the thread generation, reply pages under the
+// generation of their tree root.
+func (s *commentService) treeCacheKey(ctx context.Context, threadKey string, parentID, root int64, page, limit int, sort model.Sort, cursor string) string {
+	tail := fmt.Sprintf("parent:%d:thread:%s:page:%d:limit:%d:sort:%s:cursor:%s", parentID, threadKey, page, limit, sort, cursor)
+
+	if parentID == 0 {
+		gens, err := s.cache.Generations(ctx, genGlobalKey, genThreadKey(threadKey))
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("tree:thread:%s:gen:%d.%d:%s", threadKey, gens[0], gens[1], tail)
+	}
+
+	gens, err := s.cache.Generations(ctx, genGlobalKey, genRootKey(root))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("tree:root:%d:gen:%d.%d:%s", root, gens[0], gens[1], tail)
+}
+
+func (s *commentService) subtreeCacheKey(ctx context.Context, root, id int64, sort model.Sort) string {
+	gens, err := s.cache.Generations(ctx, genGlobalKey, genRootKey(root))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("subtree:root:%d:gen:%d.%d:id:%d:sort:%s", root, gens[0], gens[1], id, sort)
+}
+
+// cacheEntry is a cached value with the time it stops being fresh. The cache
+// keeps it for the stale window on top of that.
+type cacheEntry struct {
+	FreshUntil time.Time       `json:"fresh_until"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// loadCached returns the value cached under key or loads it. Concurrent misses
+// for one key share a single load. An entry past its freshness but within the
+// stale window is returned right away while one background load refreshes it.
+// An empty key bypasses the cache. kind labels the lookup in metrics.
+func loadCached[T any](ctx context.Context, s *commentService, kind, key string, load func(context.Context) (T, error)) (T, error) {
+	if key == "" {
+		return load(ctx)
+	}
+
+	if b, ok := s.cache.Get(ctx, key); ok {
+		var e cacheEntry
+		var v T
+		if json.Unmarshal(b, &e) == nil && json.Unmarshal(e.Value, &v) == nil {
+			if !time.Now().After(e.FreshUntil) {
+				s.metrics.lookup(kind, "hit")
+				return v, nil
+			}
+			s.metrics.lookup(kind, "stale")
+			sharedLoad(ctx, s, key, load)
+			return v, nil
+		}
+	}
+
+	s.metrics.lookup(kind, "miss")
+	// the load outlives a caller that gives up, since others may wait on it
+	var zero T
+	select {
+	case res := <-sharedLoad(ctx, s, key, load):
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// sharedLoad starts the load of key, or joins the one in flight. The load is
+// detached from ctx but bounded by refreshTimeout, so a hung query frees its
+// key for a later attempt.
+func sharedLoad[T any](ctx context.Context, s *commentService, key string, load func(context.Context) (T, error)) <-chan singleflight.Result {
+	return s.flight.DoChan(key, func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		return storeLoaded(loadCtx, s, key, load)()
+	})
+}
+
+func storeLoaded[T any](ctx context.Context, s *commentService, key string, load func(context.Context) (T, error)) func() (any, error) {
+	return func() (any, error) {
+		v, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if b, err := json.Marshal(v); err == nil {
+			e, _ := json.Marshal(cacheEntry{FreshUntil: time.Now().Add(s.cacheTTL), Value: b})
+			s.cache.Set(ctx, key, e, s.cacheTTL+s.staleTTL)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// LRUCache is an in-process cache bounded by entry count and per-entry TTL.
+//
+// Generations are bounded too. Forgetting a counter would reset it and revive
+// entries cached under its old values, so instead every forgotten counter
+// raises a floor that unknown counters start from.
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+
+	gens     map[string]int64
+	genFloor int64
+
+	now func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:    max(size, 1),
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+		gens:    make(map[string]int64),
+		now:     time.Now,
+	}
+}
+
+func (c *LRUCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	_ = ctx
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !c.now().Before(e.expires) {
+		c.removeLocked(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *LRUCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	_ = ctx
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value, e.expires = value, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.ll.Len() > c.size {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *LRUCache) removeLocked(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).key)
+}
+
+func (c *LRUCache) Generations(ctx context.Context, keys ...string) ([]int64, error) {
+	_ = ctx
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gens := make([]int64, len(keys))
+	for i, k := range keys {
+		gens[i] = c.genLocked(k)
+	}
+	return gens, nil
+}
+
+func (c *LRUCache) Bump(ctx context.Context, keys ...string) error {
+	_ = ctx
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		c.gens[k] = c.genLocked(k) + 1
+	}
+	for k, v := range c.gens {
+		if len(c.gens) <= c.size {
+			break
+		}
+		delete(c.gens, k)
+		c.genFloor = max(c.genFloor, v+1)
+	}
+	return nil
+}
+
+func (c *LRUCache) genLocked(key string) int64 {
+	if v, ok := c.gens[key]; ok {
+		return v
+	}
+	return c.genFloor
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache keeps entries and generations in Redis, shared by all replicas.
+type RedisCache struct {
+	rdb *redis.Client
+}
+
+func NewRedisCache(rdb *redis.Client) *RedisCache {
+	return &RedisCache{rdb: rdb}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	b, err := c.rdb.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	_ = c.rdb.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *RedisCache) Generations(ctx context.Context, keys ...string) ([]int64, error) {
+	vals, err := c.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]int64, len(vals))
+	for i, v := range vals {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if gens[i], err = strconv.ParseInt(str, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return gens, nil
+}
+
+func (c *RedisCache) Bump(ctx context.Context, keys ...string) error {
+	pipe := c.rdb.Pipeline()
+	for _, k := range keys {
+		pipe.Incr(ctx, k)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// TieredCache puts a local cache in front of a shared one. Generations always
+// come from the shared tier, so a write on any replica still invalidates
+// every replica's local entries; only the page bodies are served locally.
+type TieredCache struct {
+	local  Cache
+	shared Cache
+}
+
+func NewTieredCache(local, shared Cache) *TieredCache {
+	return &TieredCache{local: local, shared: shared}
+}
+
+func (c *TieredCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	if b, ok := c.local.Get(ctx, key); ok {
+		return b, true
+	}
+	b, ok := c.shared.Get(ctx, key)
+	if ok {
+		c.local.Set(ctx, key, b, localTTL)
+	}
+	return b, ok
+}
+
+func (c *TieredCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	c.local.Set(ctx, key, value, min(ttl, localTTL))
+	c.shared.Set(ctx, key, value, ttl)
+}
+
+func (c *TieredCache) Generations(ctx context.Context, keys ...string) ([]int64, error) {
+	return c.shared.Generations(ctx, keys...)
+}
+
+func (c *TieredCache) Bump(ctx context.Context, keys ...string) error {
+	return c.shared.Bump(ctx, keys...)
+}
+
+// localTTL caps how long the local tier keeps an entry. Keys are versioned,
+// so this only bounds memory held by entries nobody asks for any more.
+const localTTL = 30 * time.Second
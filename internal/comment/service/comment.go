@@ -3,15 +3,14 @@ package service
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"strings"
 	"time"
 
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/events"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage"
-	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -20,272 +19,577 @@ var (
 )
 
 type commentService struct {
-	repo storage.Repository
-	rdb  *redis.Client
+	repo   storage.Repository
+	cache  Cache
+	events events.Publisher
+	lang   model.Language
+
+	cacheTTL time.Duration
+	staleTTL time.Duration
+	flight   singleflight.Group
+	metrics  *cacheMetrics
 }
 
-func New(repo storage.Repository, rdb *redis.Client) CommentService {
-	return &commentService{repo: repo, rdb: rdb}
+type Option func(*commentService)
+
+// WithEvents publishes created, edited and deleted events to p.
+func WithEvents(p events.Publisher) Option {
+	return func(s *commentService) {
+		s.events = p
+	}
 }
 
-func (s *commentService) Create(ctx context.Context, parentID int64, text string) (model.Comment, error) {
+// WithCacheTTL sets how long cached tree pages and subtrees stay fresh.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(s *commentService) {
+		s.cacheTTL = ttl
+	}
+}
+
+// WithStaleWhileRevalidate lets an entry be served for up to d after it
+// expires while a single background load refreshes it. Zero disables it.
+func WithStaleWhileRevalidate(d time.Duration) Option {
+	return func(s *commentService) {
+		s.staleTTL = d
+	}
+}
+
+// WithLanguage indexes new comments that name no language with the text
+// search configuration lang and makes it the language of searches that name
+// none. The default is model.LanguageSimple.
+func WithLanguage(lang model.Language) Option {
+	return func(s *commentService) {
+		s.lang = lang
+	}
+}
+
+// New builds the service on repo. A nil cache disables caching.
+func New(repo storage.Repository, cache Cache, opts ...Option) CommentService {
+	if cache == nil {
+		cache = NoopCache{}
+	}
+	s := &commentService{repo: repo, cache: cache, lang: model.LanguageSimple, cacheTTL: defaultCacheTTL}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Create adds a comment. Root comments must name their thread; replies always
+// inherit the thread of their parent and threadKey is ignored for them.
+func (s *commentService) Create(ctx context.Context, threadKey string, parentID int64, lang model.Language, text string) (model.Comment, error) {
 	if err := validateText(text); err != nil {
 		return model.Comment{}, err
 	}
+	if lang == "" {
+		lang = s.lang
+	} else if err := validateLanguage(lang); err != nil {
+		return model.Comment{}, err
+	}
 	if parentID < 0 {
-		return model.Comment{}, ErrInvalidInput
+		return model.Comment{}, invalid("parent_id", CodeInvalidParent, "must not be negative")
 	}
-	if parentID != 0 {
-		ok, err := s.repo.Exists(ctx, parentID)
-		if err != nil {
+	if parentID == 0 {
+		if err := validateThreadKey(threadKey); err != nil {
 			return model.Comment{}, err
 		}
-		if !ok {
-			return model.Comment{}, ErrNotFound
-		}
 	}
-	c, err := s.repo.Create(ctx, parentID, text)
+	var author model.Author
+	if a, ok := ActorFrom(ctx); ok {
+		author = model.Author{ID: a.ID, Name: a.Name}
+	}
+	// the repository checks the parent in the same step as the insert, so a
+	// concurrent delete cannot leave the reply orphaned
+	c, err := s.repo.Create(ctx, threadKey, parentID, author, lang, text)
+	if errors.Is(err, storage.ErrParentNotFound) {
+		return model.Comment{}, ErrNotFound
+	}
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	path := s.branchPath(ctx, c.ID)
+	s.invalidateBranch(ctx, c.ThreadKey, path)
+	s.publish(ctx, events.TypeCreated, c, path, 0)
+	return c, nil
+}
+
+func (s *commentService) Update(ctx context.Context, id int64, text string) (model.Comment, error) {
+	if id <= 0 {
+		return model.Comment{}, invalid("id", CodeInvalidID, "must be a positive integer")
+	}
+	if err := validateText(text); err != nil {
+		return model.Comment{}, err
+	}
+
+	if _, err := s.authorize(ctx, id); err != nil {
+		return model.Comment{}, err
+	}
+
+	c, err := s.repo.Update(ctx, id, text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Comment{}, ErrNotFound
+	}
 	if err != nil {
 		return model.Comment{}, err
 	}
 
-	if s.rdb != nil {
-		_ = s.invalidateTreeCache(ctx, 0)
+	path := s.branchPath(ctx, c.ID)
+	s.invalidateBranch(ctx, c.ThreadKey, path)
+	s.publish(ctx, events.TypeEdited, c, path, 0)
+	return c, nil
+}
 
-		_ = s.invalidateTreeCache(ctx, parentID)
+// GetRevisions lists the earlier texts of comment id. Those of a soft-deleted
+// comment are replaced with model.DeletedText unless an admin asks: reads are
+// public, and the history must not undo the tombstone.
+func (s *commentService) GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error) {
+	if id <= 0 {
+		return nil, invalid("id", CodeInvalidID, "must be a positive integer")
+	}
 
-		if parentID != 0 {
-			path, err := s.repo.GetPath(ctx, parentID)
-			if err == nil && len(path) > 0 {
-				rootID := path[0].ID
-				_ = s.invalidateSubtreeCache(ctx, rootID)
+	c, err := s.repo.Get(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revs, err := s.repo.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if c.DeletedAt != nil {
+		if a, ok := ActorFrom(ctx); !ok || !a.Admin {
+			for i := range revs {
+				revs[i].Text = model.DeletedText
 			}
 		}
 	}
-	return c, nil
+	return revs, nil
 }
 
-func (s *commentService) GetTreePage(ctx context.Context, parentID int64, page, limit int, sortMode model.Sort) (model.TreePage, error) {
+// branchPath returns the ids from the thread root down to id, which both
+// cache invalidation and events need.
+func (s *commentService) branchPath(ctx context.Context, id int64) []int64 {
+	items, err := s.repo.GetPath(ctx, id)
+	if err != nil {
+		return nil
+	}
+	path := make([]int64, 0, len(items))
+	for _, it := range items {
+		path = append(path, it.ID)
+	}
+	return path
+}
+
+// publish reports a change to live subscribers. Delivery is best effort: a
+// failed publish never fails the write that caused it.
+func (s *commentService) publish(ctx context.Context, typ events.Type, c model.Comment, path []int64, deleted int) {
+	if s.events == nil {
+		return
+	}
+	_ = s.events.Publish(ctx, events.Event{
+		Type:      typ,
+		ThreadKey: c.ThreadKey,
+		Path:      path,
+		Comment:   c,
+		Deleted:   deleted,
+	})
+}
+
+// GetTreePage lists children of parentID. Top-level pages (parentID 0) are
+// always scoped to a thread; for replies threadKey is an optional filter.
+func (s *commentService) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sortMode model.Sort, cursor string) (model.TreePage, error) {
 	if parentID < 0 {
-		return model.TreePage{}, ErrInvalidInput
+		return model.TreePage{}, invalid("parent_id", CodeInvalidParent, "must not be negative")
+	}
+	if parentID == 0 || threadKey != "" {
+		if err := validateThreadKey(threadKey); err != nil {
+			return model.TreePage{}, err
+		}
 	}
-	if page <= 0 || limit <= 0 || limit > 100 {
-		return model.TreePage{}, ErrInvalidInput
+	if err := validatePaging(page, limit); err != nil {
+		return model.TreePage{}, err
 	}
 	if sortMode == "" {
 		sortMode = model.SortCreatedAtDesc
 	}
-	if sortMode != model.SortCreatedAtAsc && sortMode != model.SortCreatedAtDesc {
-		return model.TreePage{}, ErrInvalidInput
+	if !validTreeSort(sortMode) {
+		return model.TreePage{}, invalid("sort", CodeInvalidSort, "unknown sort mode "+string(sortMode))
+	}
+	cur, err := parseCursor(cursor, sortMode)
+	if err != nil {
+		return model.TreePage{}, err
 	}
 
+	root := int64(0)
 	if parentID != 0 {
-		ok, err := s.repo.Exists(ctx, parentID)
-		if err != nil {
+		if root, err = s.treeRoot(ctx, parentID); err != nil {
 			return model.TreePage{}, err
 		}
-		if !ok {
-			return model.TreePage{}, ErrNotFound
-		}
 	}
 
-	if s.rdb != nil {
-		key := s.treeCacheKey(parentID, page, limit, sortMode)
-		data, err := s.rdb.Get(ctx, key).Bytes()
-		if err == nil {
-			var tp model.TreePage
-			if jerr := json.Unmarshal(data, &tp); jerr == nil {
-				return tp, nil
-			}
-		}
-
-		tp, err := s.repo.GetTreePage(ctx, parentID, page, limit, sortMode)
+	key := s.treeCacheKey(ctx, threadKey, parentID, root, page, limit, sortMode, cursor)
+	return loadCached(ctx, s, "tree", key, func(ctx context.Context) (model.TreePage, error) {
+		tp, err := s.repo.GetTreePage(ctx, threadKey, parentID, page, limit, sortMode, cur)
 		if err != nil {
 			return model.TreePage{}, err
 		}
-		if b, jerr := json.Marshal(tp); jerr == nil {
-			_ = s.rdb.Set(ctx, key, b, 2*time.Minute).Err()
-		}
+		renderTombstones(tp.Items)
 		return tp, nil
-	}
-
-	return s.repo.GetTreePage(ctx, parentID, page, limit, sortMode)
+	})
 }
 
 func (s *commentService) DeleteSubtree(ctx context.Context, id int64) (int, error) {
 	if id <= 0 {
-		return 0, ErrInvalidInput
+		return 0, invalid("id", CodeInvalidID, "must be a positive integer")
 	}
 
-	ok, err := s.repo.Exists(ctx, id)
+	c, err := s.authorize(ctx, id)
 	if err != nil {
 		return 0, err
 	}
-	if !ok {
-		return 0, ErrNotFound
-	}
+	path := s.branchPath(ctx, id)
 
 	deleted, err := s.repo.DeleteSubtree(ctx, id)
 	if err != nil {
 		return 0, err
 	}
-	if s.rdb != nil {
-		_ = s.invalidateAllTreeCache(ctx)
-		_ = s.invalidateAllSubtreeCache(ctx)
-	}
+	s.invalidateBranch(ctx, c.ThreadKey, path)
+	c.Text = model.DeletedText
+	s.publish(ctx, events.TypeDeleted, c, path, deleted)
 	return deleted, nil
 }
 
-func (s *commentService) treeCacheKey(parentID int64, page, limit int, sort model.Sort) string {
-	return fmt.Sprintf("tree:parent:%d:page:%d:limit:%d:sort:%s", parentID, page, limit, string(sort))
-}
+func (s *commentService) SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error) {
+	if id <= 0 {
+		return model.Comment{}, invalid("id", CodeInvalidID, "must be a positive integer")
+	}
+
+	if _, err := s.authorize(ctx, id); err != nil {
+		return model.Comment{}, err
+	}
+	// an authenticated caller is recorded as is, not as whoever it claims
+	if a, ok := ActorFrom(ctx); ok {
+		by = a.ID
+	}
 
-func (s *commentService) subtreeCacheKey(id int64, sort model.Sort, ver int64) string {
-	return fmt.Sprintf("subtree:v:%d:root:%d:sort:%s", ver, id, string(sort))
+	c, err := s.repo.SoftDelete(ctx, id, strings.TrimSpace(by))
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Comment{}, ErrNotFound
+	}
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	path := s.branchPath(ctx, c.ID)
+	s.invalidateBranch(ctx, c.ThreadKey, path)
+	c.Text = model.DeletedText
+	s.publish(ctx, events.TypeDeleted, c, path, 1)
+	return c, nil
 }
 
-func (s *commentService) invalidateTreeCache(ctx context.Context, parentID int64) error {
-	pattern := fmt.Sprintf("tree:parent:%d:*", parentID)
-	keys, err := s.rdb.Keys(ctx, pattern).Result()
+// Restore brings a tombstone back. Authors may only undo their own deletions;
+// a comment removed by somebody else stays down until an admin restores it.
+func (s *commentService) Restore(ctx context.Context, id int64) (model.Comment, error) {
+	if id <= 0 {
+		return model.Comment{}, invalid("id", CodeInvalidID, "must be a positive integer")
+	}
+
+	cur, err := s.authorize(ctx, id)
 	if err != nil {
-		return err
+		return model.Comment{}, err
 	}
-	if len(keys) == 0 {
-		return nil
+	if a, ok := ActorFrom(ctx); ok && !a.Admin && cur.DeletedAt != nil && cur.DeletedBy != a.ID {
+		return model.Comment{}, ErrForbidden
 	}
-	return s.rdb.Del(ctx, keys...).Err()
-}
 
-func (s *commentService) invalidateAllTreeCache(ctx context.Context) error {
-	keys, err := s.rdb.Keys(ctx, "tree:parent:*").Result()
+	c, err := s.repo.Restore(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Comment{}, ErrNotFound
+	}
 	if err != nil {
-		return err
+		return model.Comment{}, err
 	}
-	if len(keys) == 0 {
-		return nil
+
+	path := s.branchPath(ctx, c.ID)
+	s.invalidateBranch(ctx, c.ThreadKey, path)
+	s.publish(ctx, events.TypeEdited, c, path, 0)
+	return c, nil
+}
+
+func (s *commentService) Move(ctx context.Context, id, newParentID int64) (model.Comment, error) {
+	if id <= 0 {
+		return model.Comment{}, invalid("id", CodeInvalidID, "must be a positive integer")
+	}
+	if newParentID < 0 || id == newParentID {
+		return model.Comment{}, invalid("parent_id", CodeInvalidParent, "must not be negative or the comment itself")
+	}
+
+	if _, err := s.authorize(ctx, id); err != nil {
+		return model.Comment{}, err
+	}
+	if newParentID != 0 {
+		ok, err := s.repo.Exists(ctx, newParentID)
+		if err != nil {
+			return model.Comment{}, err
+		}
+		if !ok {
+			return model.Comment{}, ErrNotFound
+		}
+	}
+
+	oldPath := s.branchPath(ctx, id)
+
+	c, err := s.repo.Move(ctx, id, newParentID)
+	switch {
+	case errors.Is(err, storage.ErrCycle):
+		return model.Comment{}, invalid("parent_id", CodeMoveCycle, err.Error())
+	case errors.Is(err, storage.ErrThreadMismatch):
+		return model.Comment{}, invalid("parent_id", CodeThreadMismatch, err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		return model.Comment{}, ErrNotFound
+	case err != nil:
+		return model.Comment{}, err
 	}
-	return s.rdb.Del(ctx, keys...).Err()
+
+	// the subtree leaves one tree and joins another
+	s.invalidateBranch(ctx, c.ThreadKey, oldPath)
+	s.invalidateBranch(ctx, c.ThreadKey, s.branchPath(ctx, c.ID))
+	return c, nil
 }
 
-func (s *commentService) invalidateSubtreeCache(ctx context.Context, id int64) error {
-	pattern := fmt.Sprintf("subtree:root:%d:*", id)
-	keys, err := s.rdb.Keys(ctx, pattern).Result()
-	if err != nil {
-		return err
+// Vote sets voter's vote on a comment: 1 up, -1 down, 0 to take it back. An
+// authenticated caller always votes as themselves.
+func (s *commentService) Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error) {
+	if id <= 0 {
+		return model.Comment{}, invalid("id", CodeInvalidID, "must be a positive integer")
 	}
-	if len(keys) == 0 {
-		return nil
+	if value < -1 || value > 1 {
+		return model.Comment{}, invalid("value", CodeInvalidVote, "must be -1, 0 or 1")
+	}
+	if a, ok := ActorFrom(ctx); ok {
+		voter = a.ID
+	}
+	voter = strings.TrimSpace(voter)
+	if voter == "" || len(voter) > maxVoterLen {
+		return model.Comment{}, invalid("voter", CodeInvalidVoter, "must be 1 to 128 bytes")
+	}
+
+	c, err := s.repo.Vote(ctx, id, voter, value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Comment{}, ErrNotFound
+	}
+	if err != nil {
+		return model.Comment{}, err
 	}
-	return s.rdb.Del(ctx, keys...).Err()
+
+	s.invalidateBranch(ctx, c.ThreadKey, s.branchPath(ctx, c.ID))
+	return c, nil
 }
 
-func (s *commentService) invalidateAllSubtreeCache(ctx context.Context) error {
-	keys, err := s.rdb.Keys(ctx, "subtree:root:*").Result()
+// PurgeDeleted hard-deletes tombstones older than retention that have no live
+// descendants left.
+func (s *commentService) PurgeDeleted(ctx context.Context, retention time.Duration) (int, error) {
+	if retention < 0 {
+		return 0, invalid("retention", CodeInvalidRetention, "must not be negative")
+	}
+
+	purged, err := s.repo.PurgeDeleted(ctx, time.Now().Add(-retention))
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if len(keys) == 0 {
-		return nil
+	if purged > 0 {
+		// purged comments may sit in any tree
+		s.invalidateAll(ctx)
+	}
+	return purged, nil
+}
+
+func (s *commentService) Stats(ctx context.Context, top int) (model.Stats, error) {
+	if top < 0 || top > maxLimit {
+		return model.Stats{}, invalid("top", CodeLimitOutOfRange, "must be between 0 and 100")
+	}
+	return s.repo.Stats(ctx, top)
+}
+
+func (s *commentService) FlushCache(ctx context.Context) error {
+	if err := s.cache.Bump(ctx, genGlobalKey); err != nil {
+		return err
 	}
-	return s.rdb.Del(ctx, keys...).Err()
+	s.metrics.invalidated("global")
+	return nil
 }
 
-func (s *commentService) Search(ctx context.Context, q string, page, limit int, sortMode model.Sort) (model.SearchPage, error) {
+func (s *commentService) Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sortMode model.Sort, cursor string) (model.SearchPage, error) {
 	if strings.TrimSpace(q) == "" {
-		return model.SearchPage{}, ErrInvalidInput
+		return model.SearchPage{}, invalid("q", CodeQueryEmpty, "must not be empty")
+	}
+	if threadKey != "" {
+		if err := validateThreadKey(threadKey); err != nil {
+			return model.SearchPage{}, err
+		}
+	}
+	if lang == "" {
+		lang = s.lang
+	} else if err := validateLanguage(lang); err != nil {
+		return model.SearchPage{}, err
 	}
-	if page <= 0 || limit <= 0 || limit > 100 {
-		return model.SearchPage{}, ErrInvalidInput
+	if err := validatePaging(page, limit); err != nil {
+		return model.SearchPage{}, err
 	}
 
 	switch sortMode {
-	case "", model.SortRankDesc, model.SortCreatedAtAsc, model.SortCreatedAtDesc:
+	case "":
+		sortMode = model.SortRankDesc
+	case model.SortRankDesc, model.SortCreatedAtAsc, model.SortCreatedAtDesc:
 	default:
-		return model.SearchPage{}, ErrInvalidInput
+		return model.SearchPage{}, invalid("sort", CodeInvalidSort, "unknown sort mode "+string(sortMode))
 	}
+	cur, err := parseCursor(cursor, sortMode)
+	if err != nil {
+		return model.SearchPage{}, err
+	}
+
+	return s.repo.Search(ctx, threadKey, q, lang, page, limit, sortMode, cur)
+}
 
-	return s.repo.Search(ctx, q, page, limit, sortMode)
+func validTreeSort(s model.Sort) bool {
+	switch s {
+	case model.SortCreatedAtAsc, model.SortCreatedAtDesc,
+		model.SortScoreDesc, model.SortControversial, model.SortBest:
+		return true
+	}
+	return false
+}
+
+// parseCursor decodes an optional page cursor and checks that it was issued
+// for the same sort mode. Vote-based sorts are never paged by cursor.
+func parseCursor(cursor string, sortMode model.Sort) (*model.Cursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	if sortMode.ByVotes() {
+		return nil, invalid("cursor", CodeInvalidCursor, "sort "+string(sortMode)+" is paged by page number only")
+	}
+	c, err := model.DecodeCursor(cursor)
+	if err != nil {
+		return nil, invalid("cursor", CodeInvalidCursor, "malformed cursor")
+	}
+	if c.Sort != sortMode {
+		return nil, invalid("cursor", CodeInvalidCursor, "cursor was issued for sort "+string(c.Sort))
+	}
+	return &c, nil
 }
 
 func (s *commentService) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
 	if id <= 0 {
-		return nil, ErrInvalidInput
+		return nil, invalid("id", CodeInvalidID, "must be a positive integer")
 	}
 	items, err := s.repo.GetPath(ctx, id)
-	if err == sql.ErrNoRows {
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNotFound
 	}
 	if err != nil {
 		return nil, err
 	}
+	for i := range items {
+		if items[i].Deleted {
+			items[i].Text = model.DeletedText
+		}
+	}
 	return items, nil
 }
 
 func (s *commentService) GetSubtree(ctx context.Context, id int64, sortMode model.Sort) (model.CommentNode, error) {
 	if id <= 0 {
-		return model.CommentNode{}, ErrInvalidInput
+		return model.CommentNode{}, invalid("id", CodeInvalidID, "must be a positive integer")
 	}
 	if sortMode == "" {
 		sortMode = model.SortCreatedAtDesc
 	}
-	if sortMode != model.SortCreatedAtAsc && sortMode != model.SortCreatedAtDesc {
-		return model.CommentNode{}, ErrInvalidInput
+	if !validTreeSort(sortMode) {
+		return model.CommentNode{}, invalid("sort", CodeInvalidSort, "unknown sort mode "+string(sortMode))
 	}
 
-	if s.rdb != nil {
-		ver := s.getVer(ctx, s.subtreeVerKey(id))
-		key := s.subtreeCacheKey(id, sortMode, ver)
-
-		if b, err := s.rdb.Get(ctx, key).Bytes(); err == nil {
-			var node model.CommentNode
-			if jerr := json.Unmarshal(b, &node); jerr == nil {
-				return node, nil
-			}
-		}
-
-		node, err := s.repo.GetSubtree(ctx, id, sortMode)
-		if err == sql.ErrNoRows {
+	root, err := s.treeRoot(ctx, id)
+	if err != nil {
+		return model.CommentNode{}, err
+	}
+	key := s.subtreeCacheKey(ctx, root, id, sortMode)
+	return loadCached(ctx, s, "subtree", key, func(ctx context.Context) (model.CommentNode, error) {
+		n, err := s.repo.GetSubtree(ctx, id, sortMode)
+		if errors.Is(err, sql.ErrNoRows) {
 			return model.CommentNode{}, ErrNotFound
 		}
 		if err != nil {
 			return model.CommentNode{}, err
 		}
+		renderTombstone(&n)
+		return n, nil
+	})
+}
 
-		if b, jerr := json.Marshal(node); jerr == nil {
-			_ = s.rdb.Set(ctx, key, b, 2*time.Minute).Err()
-		}
-		return node, nil
+// renderTombstone hides the text of soft-deleted comments while keeping their
+// replies in place.
+func renderTombstone(n *model.CommentNode) {
+	if n.DeletedAt != nil {
+		n.Text = model.DeletedText
 	}
+	renderTombstones(n.Children)
+}
 
-	n, err := s.repo.GetSubtree(ctx, id, sortMode)
-	if err == sql.ErrNoRows {
-		return model.CommentNode{}, ErrNotFound
+func renderTombstones(nodes []model.CommentNode) {
+	for i := range nodes {
+		renderTombstone(&nodes[i])
 	}
-	if err != nil {
-		return model.CommentNode{}, err
-	}
-	return n, nil
 }
 
-func (s *commentService) subtreeVerKey(rootID int64) string {
-	return fmt.Sprintf("ver:subtree:root:%d", rootID)
+func validateText(text string) error {
+	t := strings.TrimSpace(text)
+	if t == "" {
+		return invalid("text", CodeTextEmpty, "must not be empty")
+	}
+	if len(t) > maxTextLen {
+		return invalid("text", CodeTextTooLong, "must be at most 2000 bytes")
+	}
+	return nil
 }
 
-func (s *commentService) getVer(ctx context.Context, key string) int64 {
-	if s.rdb == nil {
-		return 1
+func validatePaging(page, limit int) error {
+	if page <= 0 {
+		return invalid("page", CodePageOutOfRange, "must be at least 1")
 	}
-	v, err := s.rdb.Get(ctx, key).Int64()
-	if err == nil && v > 0 {
-		return v
+	if limit <= 0 || limit > maxLimit {
+		return invalid("limit", CodeLimitOutOfRange, "must be between 1 and 100")
 	}
-	return 1
+	return nil
 }
 
-func validateText(text string) error {
-	t := strings.TrimSpace(text)
-	if t == "" || len(t) > 2000 {
-		return ErrInvalidInput
+func validateLanguage(lang model.Language) error {
+	if !lang.Valid() {
+		return invalid("lang", CodeInvalidLang, "unknown text search language "+string(lang))
+	}
+	return nil
+}
+
+// validateThreadKey accepts keys such as "article:42" or "products/sku-1".
+func validateThreadKey(key string) error {
+	if key == "" {
+		return invalid("thread_key", CodeThreadRequired, "must not be empty")
+	}
+	if len(key) > maxThreadKeyLen {
+		return invalid("thread_key", CodeInvalidThreadKey, "must be at most 128 bytes")
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-_.:/", r):
+		default:
+			return invalid("thread_key", CodeInvalidThreadKey, "may contain only letters, digits and -_.:/")
+		}
 	}
 	return nil
 }
@@ -0,0 +1,54 @@
+package service
+
+// Validation codes reported in ValidationError.Code. Clients may switch on
+// them, so existing values must not change.
+const (
+	CodeInvalidID        = "invalid_id"
+	CodeInvalidParent    = "invalid_parent"
+	CodeTextEmpty        = "text_empty"
+	CodeTextTooLong      = "text_too_long"
+	CodeThreadRequired   = "thread_required"
+	CodeInvalidThreadKey = "invalid_thread_key"
+	CodePageOutOfRange   = "page_out_of_range"
+	CodeLimitOutOfRange  = "limit_out_of_range"
+	CodeInvalidSort      = "invalid_sort"
+	CodeInvalidCursor    = "invalid_cursor"
+	CodeQueryEmpty       = "query_empty"
+	CodeInvalidVote      = "invalid_vote"
+	CodeInvalidVoter     = "invalid_voter"
+	CodeMoveCycle        = "move_cycle"
+	CodeThreadMismatch   = "thread_mismatch"
+	CodeInvalidRetention = "invalid_retention"
+	CodeInvalidFormat    = "invalid_format"
+	CodeInvalidRecord    = "invalid_record"
+	CodeInvalidRepair    = "invalid_repair"
+	CodeInvalidLang      = "invalid_lang"
+)
+
+const (
+	maxTextLen      = 2000
+	maxThreadKeyLen = 128
+	maxVoterLen     = 128
+	maxLimit        = 100
+)
+
+// ValidationError tells which input was rejected and why. It matches
+// ErrInvalidInput under errors.Is, so callers that only need the category
+// keep working.
+type ValidationError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func invalid(field, code, message string) *ValidationError {
+	return &ValidationError{Field: field, Code: code, Message: message}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidInput
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+)
+
+// Repair strategies of CheckIntegrity. Both detach orphans, and cycles at
+// their smallest id, then rebuild threads, paths and depths from the parent
+// links.
+const (
+	// RepairReroot makes detached comments top-level in their own thread.
+	RepairReroot = "reroot"
+	// RepairQuarantine moves detached comments under one top-level comment in
+	// QuarantineThread, where they can be reviewed.
+	RepairQuarantine = "quarantine"
+)
+
+// QuarantineThread is the thread RepairQuarantine collects detached comments in.
+const QuarantineThread = "fsck:quarantine"
+
+const quarantineText = "Comments detached by the integrity check"
+
+// CheckIntegrity reads every comment's links and reports orphans, cycles,
+// replies in the wrong thread and stored paths or depths that do not match
+// the parent links. With a repair strategy it also fixes what it found. Only
+// admins may run it.
+func (s *commentService) CheckIntegrity(ctx context.Context, repair string) (model.IntegrityReport, error) {
+	if repair != "" && repair != RepairReroot && repair != RepairQuarantine {
+		return model.IntegrityReport{}, invalid("repair", CodeInvalidRepair, "must be reroot or quarantine")
+	}
+	if a, ok := ActorFrom(ctx); ok && !a.Admin {
+		return model.IntegrityReport{}, ErrForbidden
+	}
+
+	links := make(map[int64]model.TreeLink)
+	err := s.repo.ScanTree(ctx, func(l model.TreeLink) error {
+		links[l.ID] = l
+		return nil
+	})
+	if err != nil {
+		return model.IntegrityReport{}, err
+	}
+
+	report := checkTree(links)
+	if repair == "" || report.OK() {
+		return report, nil
+	}
+
+	fix := &model.IntegrityRepair{Strategy: repair}
+	reparent := make(map[int64]int64)
+	for _, id := range report.Orphans {
+		reparent[id] = 0
+	}
+	for _, cycle := range report.Cycles {
+		reparent[cycle[0]] = 0
+	}
+	if repair == RepairQuarantine && len(reparent) > 0 {
+		if fix.QuarantineID, err = s.quarantineRoot(ctx); err != nil {
+			return model.IntegrityReport{}, err
+		}
+		for id := range reparent {
+			reparent[id] = fix.QuarantineID
+		}
+	}
+
+	fix.Reattached = len(reparent)
+	if fix.Rebuilt, err = s.repo.Repair(ctx, reparent); err != nil {
+		return model.IntegrityReport{}, err
+	}
+	s.invalidateAll(ctx)
+
+	report.Repair = fix
+	return report, nil
+}
+
+// quarantineRoot returns the top-level comment of QuarantineThread, creating
+// it on first use.
+func (s *commentService) quarantineRoot(ctx context.Context) (int64, error) {
+	page, err := s.repo.GetTreePage(ctx, QuarantineThread, 0, 1, 1, model.SortCreatedAtAsc, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(page.Items) > 0 {
+		return page.Items[0].ID, nil
+	}
+	c, err := s.repo.Create(ctx, QuarantineThread, 0, model.Author{}, s.lang, quarantineText)
+	if err != nil {
+		return 0, err
+	}
+	return c.ID, nil
+}
+
+// checkTree follows every comment's parent links up to a top-level comment.
+// Each comment is visited once, so a cycle costs no more than a chain.
+func checkTree(links map[int64]model.TreeLink) model.IntegrityReport {
+	report := model.IntegrityReport{
+		Checked:          len(links),
+		Orphans:          []int64{},
+		Cycles:           [][]int64{},
+		ThreadMismatches: []int64{},
+		DepthAnomalies:   []model.DepthAnomaly{},
+	}
+
+	const (
+		unseen = iota
+		walking
+		done
+	)
+	state := make(map[int64]int, len(links))
+	// paths of the comments reachable from a top-level one
+	paths := make(map[int64]string, len(links))
+
+	ids := make([]int64, 0, len(links))
+	for id := range links {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		var chain []int64
+		reachable := false
+		for cur := id; ; {
+			if state[cur] == done {
+				_, reachable = paths[cur]
+				break
+			}
+			if state[cur] == walking {
+				i := slices.Index(chain, cur)
+				report.Cycles = append(report.Cycles, rotateToMin(chain[i:]))
+				break
+			}
+			state[cur] = walking
+			chain = append(chain, cur)
+
+			parent := links[cur].ParentID
+			if parent == 0 {
+				reachable = true
+				break
+			}
+			if _, ok := links[parent]; !ok {
+				report.Orphans = append(report.Orphans, cur)
+				break
+			}
+			cur = parent
+		}
+
+		// settle the chain top-down, so every parent has its path first
+		for i := len(chain) - 1; i >= 0; i-- {
+			cur := chain[i]
+			state[cur] = done
+			if !reachable {
+				report.Unreachable++
+				continue
+			}
+			l := links[cur]
+			if l.ParentID == 0 {
+				paths[cur] = strconv.FormatInt(cur, 10)
+			} else {
+				paths[cur] = paths[l.ParentID] + "." + strconv.FormatInt(cur, 10)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		path, ok := paths[id]
+		if !ok {
+			continue
+		}
+		l := links[id]
+		if l.ParentID != 0 && l.ThreadKey != links[l.ParentID].ThreadKey {
+			report.ThreadMismatches = append(report.ThreadMismatches, id)
+		}
+		if l.Depth < 0 {
+			continue
+		}
+		if depth := strings.Count(path, "."); l.Depth != depth || l.Path != path {
+			report.DepthAnomalies = append(report.DepthAnomalies, model.DepthAnomaly{
+				ID:          id,
+				StoredDepth: l.Depth,
+				ActualDepth: depth,
+				StoredPath:  l.Path,
+				ActualPath:  path,
+			})
+		}
+	}
+
+	slices.Sort(report.Orphans)
+	slices.SortFunc(report.Cycles, func(a, b []int64) int { return cmp.Compare(a[0], b[0]) })
+	return report
+}
+
+// rotateToMin starts a cycle at its smallest id, so a cycle reads the same
+// wherever the walk entered it.
+func rotateToMin(cycle []int64) []int64 {
+	i := slices.Index(cycle, slices.Min(cycle))
+	return append(slices.Clone(cycle[i:]), cycle[:i]...)
+}
@@ -0,0 +1,46 @@
+package service
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// cacheMetrics counts cache lookups and generation bumps. A nil *cacheMetrics
+// records nothing.
+type cacheMetrics struct {
+	lookups       *prometheus.CounterVec
+	invalidations *prometheus.CounterVec
+}
+
+// WithMetrics registers cache metrics with reg:
+// commenttree_cache_lookups_total{kind="tree|subtree",result="hit|stale|miss"}
+// and commenttree_cache_invalidations_total{generation="thread|root|global"}.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(s *commentService) {
+		m := &cacheMetrics{
+			lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "commenttree_cache_lookups_total",
+				Help: "Cache lookups of tree pages and subtrees by result.",
+			}, []string{"kind", "result"}),
+			invalidations: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "commenttree_cache_invalidations_total",
+				Help: "Cache generation bumps.",
+			}, []string{"generation"}),
+		}
+		reg.MustRegister(m.lookups, m.invalidations)
+		s.metrics = m
+	}
+}
+
+func (m *cacheMetrics) lookup(kind, result string) {
+	if m == nil {
+		return
+	}
+	m.lookups.WithLabelValues(kind, result).Inc()
+}
+
+func (m *cacheMetrics) invalidated(generations ...string) {
+	if m == nil {
+		return
+	}
+	for _, g := range generations {
+		m.invalidations.WithLabelValues(g).Inc()
+	}
+}
@@ -2,15 +2,35 @@ package service
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
 )
 
 type CommentService interface {
-	Create(ctx context.Context, parentID int64, text string) (model.Comment, error)
-	GetTreePage(ctx context.Context, parentID int64, page, limit int, sort model.Sort) (model.TreePage, error)
+	// Create indexes the text for search with lang, or with the configured
+	// language when lang is empty.
+	Create(ctx context.Context, threadKey string, parentID int64, lang model.Language, text string) (model.Comment, error)
+	Update(ctx context.Context, id int64, text string) (model.Comment, error)
+	GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error)
+	GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sort model.Sort, cursor string) (model.TreePage, error)
 	DeleteSubtree(ctx context.Context, id int64) (deleted int, err error)
-	Search(ctx context.Context, q string, page, limit int, sort model.Sort) (model.SearchPage, error)
+	SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error)
+	Restore(ctx context.Context, id int64) (model.Comment, error)
+	Move(ctx context.Context, id, newParentID int64) (model.Comment, error)
+	Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error)
+	PurgeDeleted(ctx context.Context, retention time.Duration) (purged int, err error)
+	// Search parses q with lang, or with the configured language when lang is
+	// empty, and also as written, so comments in other languages match their
+	// exact word forms.
+	Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sort model.Sort, cursor string) (model.SearchPage, error)
 	GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error)
 	GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error)
+	Stats(ctx context.Context, top int) (model.Stats, error)
+	// FlushCache makes every cached page stale at once.
+	FlushCache(ctx context.Context) error
+	Export(ctx context.Context, threadKey string, rootID int64, format Format, w io.Writer) error
+	Import(ctx context.Context, threadKey string, parentID int64, format Format, r io.Reader) (model.ImportResult, error)
+	CheckIntegrity(ctx context.Context, repair string) (model.IntegrityReport, error)
 }
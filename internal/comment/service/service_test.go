@@ -2,71 +2,133 @@ package service
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
 	inm "github.com/MyNameIsWhaaat/commenttree/internal/comment/storage/inmemory"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 )
 
-// fakeRepo wraps inmemory.Repo and implements remaining methods of storage.Repository
-type fakeRepo struct {
-	*inm.Repo
-}
+func TestCreateValidation(t *testing.T) {
+	repo := inm.New()
+	svc := New(repo, nil)
 
-func (f *fakeRepo) Search(ctx context.Context, q string, page, limit int, sort model.Sort) (model.SearchPage, error) {
-	return model.SearchPage{}, nil
+	_, err := svc.Create(context.Background(), "t", 0, "", "   ")
+	if err == nil {
+		t.Fatalf("expected error for empty text, got nil")
+	}
 }
 
-func (f *fakeRepo) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
-	return model.CommentNode{}, sql.ErrNoRows
+func TestValidationErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	cases := []struct {
+		name        string
+		err         error
+		field, code string
+	}{
+		{"empty text", second(svc.Create(ctx, "t", 0, "", "  ")), "text", CodeTextEmpty},
+		{"long text", second(svc.Create(ctx, "t", 0, "", strings.Repeat("x", 2001))), "text", CodeTextTooLong},
+		{"no thread", second(svc.Create(ctx, "", 0, "", "text")), "thread_key", CodeThreadRequired},
+		{"limit", second(svc.GetTreePage(ctx, "t", 0, 1, 101, "", "")), "limit", CodeLimitOutOfRange},
+		{"sort", second(svc.GetSubtree(ctx, 1, "random")), "sort", CodeInvalidSort},
+		{"cursor", second(svc.Search(ctx, "", "q", "", 1, 10, "", "garbage")), "cursor", CodeInvalidCursor},
+		{"lang", second(svc.Search(ctx, "", "q", "klingon", 1, 10, "", "")), "lang", CodeInvalidLang},
+	}
+	for _, tc := range cases {
+		var ve *ValidationError
+		if !errors.As(tc.err, &ve) || ve.Field != tc.field || ve.Code != tc.code {
+			t.Errorf("%s: expected %s/%s, got %v", tc.name, tc.field, tc.code, tc.err)
+		}
+		if !errors.Is(tc.err, ErrInvalidInput) {
+			t.Errorf("%s: expected error to match ErrInvalidInput", tc.name)
+		}
+	}
 }
 
-func (f *fakeRepo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
-	return nil, sql.ErrNoRows
+func second[T any](_ T, err error) error {
+	return err
 }
 
-func TestCreateValidation(t *testing.T) {
-	repo := &fakeRepo{inm.New()}
+func TestCreateParentNotFound(t *testing.T) {
+	repo := inm.New()
 	svc := New(repo, nil)
 
-	_, err := svc.Create(context.Background(), 0, "   ")
-	if err == nil {
-		t.Fatalf("expected error for empty text, got nil")
+	_, err := svc.Create(context.Background(), "t", 9999, "", "hello")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing parent, got %v", err)
 	}
 }
 
-func TestCreateParentNotFound(t *testing.T) {
-	repo := &fakeRepo{inm.New()}
-	svc := New(repo, nil)
+func TestCreateRacingDeleteLeavesNoOrphans(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
 
-	_, err := svc.Create(context.Background(), 9999, "hello")
-	if err == nil {
-		t.Fatalf("expected ErrNotFound for missing parent, got nil")
+	for range 20 {
+		root, _ := svc.Create(ctx, "t", 0, "", "root")
+		reply, _ := svc.Create(ctx, "", root.ID, "", "reply")
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := svc.Create(ctx, "", reply.ID, "", "late"); err != nil && !errors.Is(err, ErrNotFound) {
+					errs <- err
+				}
+			}()
+		}
+		if _, err := svc.DeleteSubtree(ctx, root.ID); err != nil {
+			t.Fatalf("DeleteSubtree: %v", err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	r, err := svc.CheckIntegrity(ctx, "")
+	if err != nil {
+		t.Fatalf("CheckIntegrity: %v", err)
+	}
+	if !r.OK() {
+		t.Fatalf("expected an intact tree, got %+v", r)
 	}
 }
 
 func TestCreateAndDeleteSubtree(t *testing.T) {
 	ctx := context.Background()
-	repo := &fakeRepo{inm.New()}
+	repo := inm.New()
 	svc := New(repo, nil)
 
-	root, err := svc.Create(ctx, 0, "root")
+	root, err := svc.Create(ctx, "t", 0, "", "root")
 	if err != nil {
 		t.Fatalf("create root: %v", err)
 	}
 
-	_, err = svc.Create(ctx, root.ID, "child1")
+	_, err = svc.Create(ctx, "", root.ID, "", "child1")
 	if err != nil {
 		t.Fatalf("create child1: %v", err)
 	}
-	_, err = svc.Create(ctx, root.ID, "child2")
+	_, err = svc.Create(ctx, "", root.ID, "", "child2")
 	if err != nil {
 		t.Fatalf("create child2: %v", err)
 	}
 
 	// ensure GetTreePage reports total 2 children for parent root
-	tp, err := svc.GetTreePage(ctx, root.ID, 1, 10, model.SortCreatedAtDesc)
+	tp, err := svc.GetTreePage(ctx, "", root.ID, 1, 10, model.SortCreatedAtDesc, "")
 	if err != nil {
 		t.Fatalf("GetTreePage: %v", err)
 	}
@@ -85,18 +147,18 @@ func TestCreateAndDeleteSubtree(t *testing.T) {
 
 func TestGetTreePagePagination(t *testing.T) {
 	ctx := context.Background()
-	repo := &fakeRepo{inm.New()}
+	repo := inm.New()
 	svc := New(repo, nil)
 
 	// create 5 top-level comments
 	for i := 0; i < 5; i++ {
-		_, err := svc.Create(ctx, 0, "c")
+		_, err := svc.Create(ctx, "t", 0, "", "c")
 		if err != nil {
 			t.Fatalf("create: %v", err)
 		}
 	}
 
-	tp, err := svc.GetTreePage(ctx, 0, 1, 2, model.SortCreatedAtDesc)
+	tp, err := svc.GetTreePage(ctx, "t", 0, 1, 2, model.SortCreatedAtDesc, "")
 	if err != nil {
 		t.Fatalf("GetTreePage: %v", err)
 	}
@@ -107,3 +169,1179 @@ func TestGetTreePagePagination(t *testing.T) {
 		t.Fatalf("expected page size 2, got %d", len(tp.Items))
 	}
 }
+
+func TestSearchSubtreeAndPath(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	root, err := svc.Create(ctx, "t", 0, "", "Hello world")
+	if err != nil {
+		t.Fatalf("create root: %v", err)
+	}
+	child, err := svc.Create(ctx, "", root.ID, "", "hello again, hello")
+	if err != nil {
+		t.Fatalf("create child: %v", err)
+	}
+	if _, err := svc.Create(ctx, "t", 0, "", "unrelated"); err != nil {
+		t.Fatalf("create other: %v", err)
+	}
+
+	sp, err := svc.Search(ctx, "", "HELLO", "", 1, 10, model.SortRankDesc, "")
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if sp.Total != 2 {
+		t.Fatalf("expected 2 matches, got %d", sp.Total)
+	}
+	if sp.Items[0].ID != child.ID {
+		t.Fatalf("expected child ranked first, got %d", sp.Items[0].ID)
+	}
+	if !strings.Contains(sp.Items[0].Snippet, "<mark>hello</mark>") {
+		t.Fatalf("expected highlighted snippet, got %q", sp.Items[0].Snippet)
+	}
+
+	sp, err = svc.Search(ctx, "", "hello world", "", 1, 10, model.SortCreatedAtAsc, "")
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if sp.Total != 1 || sp.Items[0].ID != root.ID {
+		t.Fatalf("expected only root to match all terms, got %+v", sp.Items)
+	}
+
+	node, err := svc.GetSubtree(ctx, root.ID, model.SortCreatedAtAsc)
+	if err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	if len(node.Children) != 1 || node.Children[0].ID != child.ID {
+		t.Fatalf("unexpected subtree: %+v", node)
+	}
+
+	path, err := svc.GetPath(ctx, child.ID)
+	if err != nil {
+		t.Fatalf("GetPath: %v", err)
+	}
+	if len(path) != 2 || path[0].ID != root.ID || path[1].ID != child.ID {
+		t.Fatalf("unexpected path: %+v", path)
+	}
+
+	if _, err := svc.GetPath(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing path, got %v", err)
+	}
+	if _, err := svc.GetSubtree(ctx, 9999, ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing subtree, got %v", err)
+	}
+}
+
+func TestSearchLanguage(t *testing.T) {
+	ctx := context.Background()
+	repo := inm.New()
+	english := New(repo, nil, WithLanguage("english"))
+	simple := New(repo, nil)
+
+	en, err := english.Create(ctx, "t", 0, "", "nice comment")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if en.Lang != "english" {
+		t.Fatalf("expected the configured language, got %q", en.Lang)
+	}
+	plain, _ := simple.Create(ctx, "", en.ID, "", "another comment")
+	if plain.Lang != model.LanguageSimple {
+		t.Fatalf("expected simple by default, got %q", plain.Lang)
+	}
+	ru, err := simple.Create(ctx, "", en.ID, "russian", "comment по-русски")
+	if err != nil || ru.Lang != "russian" {
+		t.Fatalf("expected the requested language, got %q, %v", ru.Lang, err)
+	}
+	if _, err := simple.Create(ctx, "", en.ID, "klingon", "text"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for an unknown language, got %v", err)
+	}
+
+	// changing the configured language must not hide older comments
+	for _, svc := range []CommentService{english, simple} {
+		for _, lang := range []model.Language{"", "english", "russian"} {
+			sp, err := svc.Search(ctx, "", "comment", lang, 1, 10, model.SortCreatedAtAsc, "")
+			if err != nil {
+				t.Fatalf("Search %q: %v", lang, err)
+			}
+			if sp.Total != 3 {
+				t.Fatalf("search in %q: expected every comment, got %+v", lang, sp.Items)
+			}
+		}
+	}
+
+	var buf strings.Builder
+	if err := english.Export(ctx, "t", 0, FormatNDJSON, &buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	res, err := simple.Import(ctx, "copy", 0, FormatNDJSON, strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	node, err := simple.GetSubtree(ctx, res.Roots[0], model.SortCreatedAtAsc)
+	if err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	if node.Lang != "english" || len(node.Children) != 2 || node.Children[1].Lang != "russian" {
+		t.Fatalf("expected the import to keep languages, got %+v", node)
+	}
+
+	_, err = simple.Import(ctx, "copy", 0, FormatNDJSON, strings.NewReader(`{"id":1,"thread_key":"x","text":"a","lang":"klingon"}`))
+	var ve *ValidationError
+	if !errors.As(err, &ve) || ve.Code != CodeInvalidLang {
+		t.Fatalf("expected %s for an unknown language, got %v", CodeInvalidLang, err)
+	}
+}
+
+func TestUpdateKeepsRevisions(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	c, err := svc.Create(ctx, "t", 0, "", "first")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if _, err := svc.Update(ctx, c.ID, "  "); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for empty text, got %v", err)
+	}
+	if _, err := svc.Update(ctx, 9999, "text"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing comment, got %v", err)
+	}
+
+	if _, err := svc.Update(ctx, c.ID, "second"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	updated, err := svc.Update(ctx, c.ID, "third")
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if updated.Text != "third" || updated.EditedAt == nil {
+		t.Fatalf("unexpected updated comment: %+v", updated)
+	}
+
+	revs, err := svc.GetRevisions(ctx, c.ID)
+	if err != nil {
+		t.Fatalf("GetRevisions: %v", err)
+	}
+	if len(revs) != 2 || revs[0].Text != "first" || revs[1].Text != "second" {
+		t.Fatalf("unexpected revisions: %+v", revs)
+	}
+}
+
+func TestSoftDeleteKeepsReplies(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	root, err := svc.Create(ctx, "t", 0, "", "root")
+	if err != nil {
+		t.Fatalf("create root: %v", err)
+	}
+	bad, err := svc.Create(ctx, "", root.ID, "", "spam spam")
+	if err != nil {
+		t.Fatalf("create bad: %v", err)
+	}
+	reply, err := svc.Create(ctx, "", bad.ID, "", "legit reply")
+	if err != nil {
+		t.Fatalf("create reply: %v", err)
+	}
+
+	tomb, err := svc.SoftDelete(ctx, bad.ID, "mod")
+	if err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+	if tomb.DeletedAt == nil || tomb.DeletedBy != "mod" || tomb.Text != model.DeletedText {
+		t.Fatalf("unexpected tombstone: %+v", tomb)
+	}
+
+	node, err := svc.GetSubtree(ctx, root.ID, model.SortCreatedAtAsc)
+	if err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	got := node.Children[0]
+	if got.Text != model.DeletedText || len(got.Children) != 1 || got.Children[0].ID != reply.ID {
+		t.Fatalf("expected tombstone with reply kept, got %+v", got)
+	}
+
+	sp, err := svc.Search(ctx, "", "spam", "", 1, 10, "", "")
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if sp.Total != 0 {
+		t.Fatalf("expected deleted comment hidden from search, got %d", sp.Total)
+	}
+
+	if _, err := svc.Update(ctx, bad.ID, "edit"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound editing tombstone, got %v", err)
+	}
+
+	restored, err := svc.Restore(ctx, bad.ID)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if restored.DeletedAt != nil || restored.Text != "spam spam" {
+		t.Fatalf("unexpected restored comment: %+v", restored)
+	}
+}
+
+func TestPurgeDeletedSkipsLiveDescendants(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+	child, _ := svc.Create(ctx, "", root.ID, "", "child")
+	leaf, _ := svc.Create(ctx, "", child.ID, "", "leaf")
+	other, _ := svc.Create(ctx, "", root.ID, "", "other")
+	if _, err := svc.Create(ctx, "", other.ID, "", "live reply"); err != nil {
+		t.Fatalf("create live reply: %v", err)
+	}
+
+	for _, id := range []int64{child.ID, leaf.ID, other.ID} {
+		if _, err := svc.SoftDelete(ctx, id, ""); err != nil {
+			t.Fatalf("SoftDelete %d: %v", id, err)
+		}
+	}
+	if _, err := svc.SoftDelete(ctx, root.ID, ""); err != nil {
+		t.Fatalf("SoftDelete root: %v", err)
+	}
+	if _, err := svc.Restore(ctx, root.ID); err != nil {
+		t.Fatalf("Restore root: %v", err)
+	}
+
+	purged, err := svc.PurgeDeleted(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("PurgeDeleted: %v", err)
+	}
+	if purged != 0 {
+		t.Fatalf("expected nothing purged within retention, got %d", purged)
+	}
+
+	purged, err = svc.PurgeDeleted(ctx, 0)
+	if err != nil {
+		t.Fatalf("PurgeDeleted: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("expected child and leaf purged, got %d", purged)
+	}
+
+	node, err := svc.GetSubtree(ctx, root.ID, "")
+	if err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	if len(node.Children) != 1 || node.Children[0].ID != other.ID {
+		t.Fatalf("expected only the tombstone with a live reply left, got %+v", node.Children)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	a, _ := svc.Create(ctx, "a", 0, "", "root a")
+	child, _ := svc.Create(ctx, "", a.ID, "", "child")
+	if _, err := svc.Create(ctx, "", child.ID, "", "grandchild"); err != nil {
+		t.Fatalf("create grandchild: %v", err)
+	}
+	b, _ := svc.Create(ctx, "b", 0, "", "root b")
+	if _, err := svc.SoftDelete(ctx, b.ID, ""); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+	if _, err := svc.Create(ctx, "c", 0, "", "root c"); err != nil {
+		t.Fatalf("create c: %v", err)
+	}
+
+	st, err := svc.Stats(ctx, 2)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if st.Comments != 5 || st.Deleted != 1 || st.Threads != 3 || st.MaxDepth != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	want := []model.ThreadStats{{ThreadKey: "a", Comments: 3}, {ThreadKey: "b", Comments: 1}}
+	if !slices.Equal(st.TopThreads, want) {
+		t.Fatalf("expected top threads %+v, got %+v", want, st.TopThreads)
+	}
+
+	if _, err := svc.Stats(ctx, -1); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for negative top, got %v", err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	root, _ := svc.Create(ctx, "src", 0, "", "root")
+	child, _ := svc.Create(ctx, "", root.ID, "", "child")
+	if _, err := svc.Create(ctx, "", child.ID, "", "grandchild"); err != nil {
+		t.Fatalf("create grandchild: %v", err)
+	}
+	gone, _ := svc.Create(ctx, "", root.ID, "", "gone")
+	if _, err := svc.SoftDelete(ctx, gone.ID, "mod"); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+	if _, err := svc.Create(ctx, "src", 0, "", "second root"); err != nil {
+		t.Fatalf("create second root: %v", err)
+	}
+	original, _ := svc.GetSubtree(ctx, root.ID, model.SortCreatedAtAsc)
+
+	for _, c := range []struct {
+		actor Actor
+		text  string
+	}{{Actor{ID: "alice"}, model.DeletedText}, {Actor{ID: "mod", Admin: true}, `"gone"`}} {
+		var buf strings.Builder
+		if err := svc.Export(WithActor(ctx, c.actor), "", root.ID, FormatNDJSON, &buf); err != nil {
+			t.Fatalf("Export as %+v: %v", c.actor, err)
+		}
+		if !strings.Contains(buf.String(), c.text) {
+			t.Fatalf("expected %s in the export of %+v, got %s", c.text, c.actor, buf.String())
+		}
+	}
+
+	for _, format := range []Format{FormatJSON, FormatNDJSON} {
+		var buf strings.Builder
+		if err := svc.Export(ctx, "", root.ID, format, &buf); err != nil {
+			t.Fatalf("%s: Export: %v", format, err)
+		}
+
+		dst := "copy-" + string(format)
+		res, err := svc.Import(ctx, dst, 0, format, strings.NewReader(buf.String()))
+		if err != nil {
+			t.Fatalf("%s: Import: %v", format, err)
+		}
+		if res.Imported != 4 || len(res.Roots) != 1 || res.ThreadKey != dst {
+			t.Fatalf("%s: unexpected result %+v", format, res)
+		}
+
+		copied, err := svc.GetSubtree(ctx, res.Roots[0], model.SortCreatedAtAsc)
+		if err != nil {
+			t.Fatalf("%s: GetSubtree: %v", format, err)
+		}
+		if got, want := shape(copied), shape(original); got != want {
+			t.Fatalf("%s: expected tree %s, got %s", format, want, got)
+		}
+		if !copied.CreatedAt.Equal(original.CreatedAt) || copied.ID == original.ID || copied.ThreadKey != dst {
+			t.Fatalf("%s: expected a new id in %s with created_at kept, got %+v", format, dst, copied.Comment)
+		}
+		if del := copied.Children[1]; del.DeletedAt == nil || del.DeletedBy != "mod" {
+			t.Fatalf("%s: expected the tombstone kept, got %+v", format, del.Comment)
+		}
+		// the stored text of the tombstone survives the round trip
+		var again strings.Builder
+		if err := svc.Export(ctx, "", copied.ID, FormatNDJSON, &again); err != nil {
+			t.Fatalf("%s: Export copy: %v", format, err)
+		}
+		if !strings.Contains(again.String(), `"gone"`) {
+			t.Fatalf("%s: expected the deleted text kept, got %s", format, again.String())
+		}
+	}
+
+	var thread strings.Builder
+	if err := svc.Export(ctx, "src", 0, FormatNDJSON, &thread); err != nil {
+		t.Fatalf("Export thread: %v", err)
+	}
+	if n := strings.Count(thread.String(), "\n"); n != 5 {
+		t.Fatalf("expected 5 lines for the thread, got %d", n)
+	}
+	// without a destination the thread of the export is kept
+	res, err := svc.Import(ctx, "", child.ID, FormatNDJSON, strings.NewReader(thread.String()))
+	if err != nil {
+		t.Fatalf("Import under a reply: %v", err)
+	}
+	if len(res.Roots) != 2 || res.ThreadKey != "src" {
+		t.Fatalf("expected both roots under the reply, got %+v", res)
+	}
+}
+
+// shape renders the texts of a tree, which an import must reproduce.
+func shape(n model.CommentNode) string {
+	parts := make([]string, 0, len(n.Children))
+	for _, ch := range n.Children {
+		parts = append(parts, shape(ch))
+	}
+	return n.Text + "(" + strings.Join(parts, ",") + ")"
+}
+
+func TestImportValidation(t *testing.T) {
+	ctx := context.Background()
+	repo := inm.New()
+	svc := New(repo, nil)
+
+	cases := map[string]struct {
+		body string
+		code string
+	}{
+		"orphan":    {`{"id":1,"parent_id":0,"text":"a"}` + "\n" + `{"id":3,"parent_id":2,"text":"b"}`, CodeInvalidParent},
+		"duplicate": {`{"id":1,"parent_id":0,"text":"a"}` + "\n" + `{"id":1,"parent_id":0,"text":"b"}`, CodeInvalidID},
+		"empty":     {`{"id":1,"parent_id":0,"text":" "}`, CodeTextEmpty},
+		"garbage":   {`{"id":1,"parent_id":0,"text":"a"}` + "\n" + `nope`, CodeInvalidRecord},
+	}
+	for name, tc := range cases {
+		_, err := svc.Import(ctx, "t", 0, FormatNDJSON, strings.NewReader(tc.body))
+		var ve *ValidationError
+		if !errors.As(err, &ve) || ve.Code != tc.code {
+			t.Fatalf("%s: expected %s, got %v", name, tc.code, err)
+		}
+	}
+	if st, _ := repo.Stats(ctx, 0); st.Comments != 0 {
+		t.Fatalf("expected failed imports to leave nothing, got %d comments", st.Comments)
+	}
+
+	user := WithActor(ctx, Actor{ID: "bob"})
+	if _, err := svc.Import(user, "t", 0, FormatJSON, strings.NewReader(`[]`)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden for a non-admin, got %v", err)
+	}
+	if err := svc.Export(ctx, "", 999, FormatJSON, io.Discard); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCheckTree(t *testing.T) {
+	link := func(id, parent int64, thread, path string, depth int) model.TreeLink {
+		return model.TreeLink{ID: id, ParentID: parent, ThreadKey: thread, Path: path, Depth: depth}
+	}
+	links := map[int64]model.TreeLink{}
+	for _, l := range []model.TreeLink{
+		link(1, 0, "t", "1", 0),
+		link(2, 1, "t", "1.2", 1),
+		link(3, 2, "t", "1.3", 1), // stale path after a move
+		link(4, 1, "u", "1.4", 1), // wrong thread
+		link(5, 99, "t", "99.5", 1),
+		link(6, 5, "t", "99.5.6", 2),
+		link(8, 7, "t", "7.8", 1), // cycle 7 -> 9 -> 8 -> 7
+		link(9, 8, "t", "7.8.9", 2),
+		link(7, 9, "t", "7", 0),
+		link(10, 9, "t", "7.8.9.10", 3),
+	} {
+		links[l.ID] = l
+	}
+
+	r := checkTree(links)
+	if r.Checked != 10 || r.Unreachable != 6 || r.OK() {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if !slices.Equal(r.Orphans, []int64{5}) {
+		t.Fatalf("expected orphan 5, got %v", r.Orphans)
+	}
+	if len(r.Cycles) != 1 || !slices.Equal(r.Cycles[0], []int64{7, 9, 8}) {
+		t.Fatalf("expected cycle 7 9 8, got %v", r.Cycles)
+	}
+	if !slices.Equal(r.ThreadMismatches, []int64{4}) {
+		t.Fatalf("expected thread mismatch at 4, got %v", r.ThreadMismatches)
+	}
+	if len(r.DepthAnomalies) != 1 || r.DepthAnomalies[0] != (model.DepthAnomaly{ID: 3, StoredDepth: 1, ActualDepth: 2, StoredPath: "1.3", ActualPath: "1.2.3"}) {
+		t.Fatalf("expected the stale path of 3, got %+v", r.DepthAnomalies)
+	}
+}
+
+func TestCheckIntegrityRepairs(t *testing.T) {
+	ctx := context.Background()
+	repo := inm.New()
+	svc := New(repo, nil)
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+	a, _ := svc.Create(ctx, "", root.ID, "", "a")
+	b, _ := svc.Create(ctx, "", a.ID, "", "b")
+	lost, _ := svc.Create(ctx, "", root.ID, "", "lost")
+	if _, err := svc.Create(ctx, "", lost.ID, "", "below lost"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// break the tree the way manual edits would
+	if _, err := repo.Repair(ctx, map[int64]int64{a.ID: b.ID, lost.ID: 999}); err != nil {
+		t.Fatalf("corrupt: %v", err)
+	}
+
+	r, err := svc.CheckIntegrity(ctx, "")
+	if err != nil {
+		t.Fatalf("CheckIntegrity: %v", err)
+	}
+	if !slices.Equal(r.Orphans, []int64{lost.ID}) || len(r.Cycles) != 1 || r.Unreachable != 4 || r.Repair != nil {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	if _, err := svc.CheckIntegrity(WithActor(ctx, Actor{ID: "bob"}), RepairReroot); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden for a non-admin, got %v", err)
+	}
+	if _, err := svc.CheckIntegrity(ctx, "rm"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for an unknown strategy, got %v", err)
+	}
+
+	r, err = svc.CheckIntegrity(ctx, RepairQuarantine)
+	if err != nil {
+		t.Fatalf("CheckIntegrity quarantine: %v", err)
+	}
+	if r.Repair == nil || r.Repair.Reattached != 2 || r.Repair.QuarantineID == 0 {
+		t.Fatalf("unexpected repair %+v", r.Repair)
+	}
+	q, err := svc.GetSubtree(ctx, r.Repair.QuarantineID, model.SortCreatedAtAsc)
+	if err != nil {
+		t.Fatalf("GetSubtree quarantine: %v", err)
+	}
+	if got := shape(q); got != quarantineText+"(a(b()),lost(below lost()))" {
+		t.Fatalf("unexpected quarantine tree %s", got)
+	}
+	if q.Children[1].Children[0].ThreadKey != QuarantineThread {
+		t.Fatalf("expected moved replies in %s, got %q", QuarantineThread, q.Children[1].Children[0].ThreadKey)
+	}
+
+	if r, err := svc.CheckIntegrity(ctx, ""); err != nil || !r.OK() {
+		t.Fatalf("expected a clean tree after repair, got %+v %v", r, err)
+	}
+}
+
+func TestMoveSubtree(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	a, _ := svc.Create(ctx, "t", 0, "", "a")
+	b, _ := svc.Create(ctx, "t", 0, "", "b")
+	a1, _ := svc.Create(ctx, "", a.ID, "", "a1")
+	a2, _ := svc.Create(ctx, "", a1.ID, "", "a2")
+
+	if _, err := svc.Move(ctx, a.ID, a2.ID); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput moving under own descendant, got %v", err)
+	}
+	if _, err := svc.Move(ctx, a1.ID, 9999); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing parent, got %v", err)
+	}
+
+	moved, err := svc.Move(ctx, a1.ID, b.ID)
+	if err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if moved.ParentID != b.ID {
+		t.Fatalf("expected parent %d, got %d", b.ID, moved.ParentID)
+	}
+
+	path, err := svc.GetPath(ctx, a2.ID)
+	if err != nil {
+		t.Fatalf("GetPath: %v", err)
+	}
+	if len(path) != 3 || path[0].ID != b.ID {
+		t.Fatalf("expected a2 under b, got %+v", path)
+	}
+
+	tp, err := svc.GetTreePage(ctx, "", a.ID, 1, 10, "", "")
+	if err != nil {
+		t.Fatalf("GetTreePage: %v", err)
+	}
+	if tp.Total != 0 {
+		t.Fatalf("expected a to have no children after move, got %d", tp.Total)
+	}
+
+	if _, err := svc.Move(ctx, a1.ID, 0); err != nil {
+		t.Fatalf("Move to root: %v", err)
+	}
+	tp, err = svc.GetTreePage(ctx, "t", 0, 1, 10, "", "")
+	if err != nil {
+		t.Fatalf("GetTreePage: %v", err)
+	}
+	if tp.Total != 3 {
+		t.Fatalf("expected 3 roots, got %d", tp.Total)
+	}
+}
+
+func TestGetTreePageCursor(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		c, err := svc.Create(ctx, "t", 0, "", "c")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		ids = append(ids, c.ID)
+	}
+
+	first, err := svc.GetTreePage(ctx, "t", 0, 1, 2, model.SortCreatedAtAsc, "")
+	if err != nil {
+		t.Fatalf("GetTreePage: %v", err)
+	}
+	if first.PrevCursor != "" || first.NextCursor == "" {
+		t.Fatalf("unexpected cursors on first page: %+v", first)
+	}
+
+	// a comment arriving between page loads must not shift the next page
+	if _, err := svc.Create(ctx, "t", 0, "", "late"); err != nil {
+		t.Fatalf("create late: %v", err)
+	}
+
+	second, err := svc.GetTreePage(ctx, "t", 0, 1, 2, model.SortCreatedAtAsc, first.NextCursor)
+	if err != nil {
+		t.Fatalf("GetTreePage next: %v", err)
+	}
+	if len(second.Items) != 2 || second.Items[0].ID != ids[2] || second.Items[1].ID != ids[3] {
+		t.Fatalf("unexpected second page: %+v", second.Items)
+	}
+
+	back, err := svc.GetTreePage(ctx, "t", 0, 1, 2, model.SortCreatedAtAsc, second.PrevCursor)
+	if err != nil {
+		t.Fatalf("GetTreePage prev: %v", err)
+	}
+	if len(back.Items) != 2 || back.Items[0].ID != ids[0] || back.PrevCursor != "" {
+		t.Fatalf("unexpected previous page: %+v", back)
+	}
+
+	if _, err := svc.GetTreePage(ctx, "t", 0, 1, 2, model.SortCreatedAtDesc, first.NextCursor); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for cursor of another sort, got %v", err)
+	}
+	if _, err := svc.GetTreePage(ctx, "t", 0, 1, 2, model.SortCreatedAtAsc, "garbage"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for malformed cursor, got %v", err)
+	}
+}
+
+func TestSearchCursor(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := svc.Create(ctx, "t", 0, "", "needle"); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	seen := map[int64]bool{}
+	cursor := ""
+	for {
+		sp, err := svc.Search(ctx, "", "needle", "", 1, 2, "", cursor)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		for _, it := range sp.Items {
+			if seen[it.ID] {
+				t.Fatalf("item %d returned twice", it.ID)
+			}
+			seen[it.ID] = true
+		}
+		if sp.NextCursor == "" {
+			break
+		}
+		cursor = sp.NextCursor
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 items across pages, got %d", len(seen))
+	}
+}
+
+func TestThreadsAreIsolated(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	if _, err := svc.Create(ctx, "", 0, "", "no thread"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for root without thread, got %v", err)
+	}
+	if _, err := svc.Create(ctx, "bad key!", 0, "", "text"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for malformed thread key, got %v", err)
+	}
+
+	a, err := svc.Create(ctx, "article:1", 0, "", "about article 1")
+	if err != nil {
+		t.Fatalf("create a: %v", err)
+	}
+	b, err := svc.Create(ctx, "article:2", 0, "", "about article 2")
+	if err != nil {
+		t.Fatalf("create b: %v", err)
+	}
+	reply, err := svc.Create(ctx, "article:2", a.ID, "", "reply about article 1")
+	if err != nil {
+		t.Fatalf("create reply: %v", err)
+	}
+	if reply.ThreadKey != "article:1" {
+		t.Fatalf("expected reply to inherit thread, got %q", reply.ThreadKey)
+	}
+
+	tp, err := svc.GetTreePage(ctx, "article:1", 0, 1, 10, "", "")
+	if err != nil {
+		t.Fatalf("GetTreePage: %v", err)
+	}
+	if tp.Total != 1 || tp.Items[0].ID != a.ID || len(tp.Items[0].Children) != 1 {
+		t.Fatalf("unexpected thread page: %+v", tp)
+	}
+
+	if _, err := svc.GetTreePage(ctx, "", 0, 1, 10, "", ""); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for top level without thread, got %v", err)
+	}
+
+	sp, err := svc.Search(ctx, "article:2", "about", "", 1, 10, "", "")
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if sp.Total != 1 || sp.Items[0].ID != b.ID {
+		t.Fatalf("expected search scoped to thread, got %+v", sp.Items)
+	}
+
+	if _, err := svc.Move(ctx, reply.ID, b.ID); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput moving across threads, got %v", err)
+	}
+}
+
+func TestOnlyAuthorOrAdminCanChange(t *testing.T) {
+	svc := New(inm.New(), nil)
+	alice := WithActor(context.Background(), Actor{ID: "alice", Name: "Alice"})
+	bob := WithActor(context.Background(), Actor{ID: "bob"})
+	admin := WithActor(context.Background(), Actor{ID: "mod", Admin: true})
+
+	c, err := svc.Create(alice, "t", 0, "", "mine")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if c.Author.ID != "alice" || c.Author.Name != "Alice" {
+		t.Fatalf("expected author from actor, got %+v", c.Author)
+	}
+
+	if _, err := svc.Update(bob, c.ID, "hijacked"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden on update, got %v", err)
+	}
+	if _, err := svc.DeleteSubtree(bob, c.ID); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden on delete, got %v", err)
+	}
+	if _, err := svc.Update(alice, c.ID, "edited"); err != nil {
+		t.Fatalf("author update: %v", err)
+	}
+
+	d, err := svc.SoftDelete(admin, c.ID, "spoofed")
+	if err != nil {
+		t.Fatalf("admin soft delete: %v", err)
+	}
+	if d.DeletedBy != "mod" {
+		t.Fatalf("expected deleted_by from actor, got %q", d.DeletedBy)
+	}
+	if _, err := svc.Restore(alice, c.ID); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected author unable to undo moderation, got %v", err)
+	}
+	if _, err := svc.Restore(admin, c.ID); err != nil {
+		t.Fatalf("admin restore: %v", err)
+	}
+}
+
+func TestVotesAndScoreSorts(t *testing.T) {
+	ctx := context.Background()
+	svc := New(inm.New(), nil)
+
+	root, err := svc.Create(ctx, "t", 0, "", "root")
+	if err != nil {
+		t.Fatalf("create root: %v", err)
+	}
+	// loved: 2 up; split: 3 up 3 down; lone: 1 up; new: no votes
+	loved, _ := svc.Create(ctx, "", root.ID, "", "loved")
+	split, _ := svc.Create(ctx, "", root.ID, "", "split")
+	lone, _ := svc.Create(ctx, "", root.ID, "", "lone")
+	fresh, _ := svc.Create(ctx, "", root.ID, "", "new")
+
+	vote := func(id int64, voter string, value int) model.Comment {
+		t.Helper()
+		c, err := svc.Vote(ctx, id, voter, value)
+		if err != nil {
+			t.Fatalf("vote %d by %s: %v", id, voter, err)
+		}
+		return c
+	}
+	vote(loved.ID, "a", 1)
+	vote(loved.ID, "b", -1)
+	vote(loved.ID, "b", 1) // changed mind
+	for i, v := range []string{"a", "b", "c"} {
+		vote(split.ID, v, 1)
+		vote(split.ID, "x"+strconv.Itoa(i), -1)
+	}
+	vote(lone.ID, "a", 1)
+	vote(lone.ID, "z", 1)
+	if c := vote(lone.ID, "z", 0); c.Upvotes != 1 || c.Score != 1 {
+		t.Fatalf("expected retracted vote to drop, got %+v", c)
+	}
+
+	if _, err := svc.Vote(ctx, loved.ID, "a", 2); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for value 2, got %v", err)
+	}
+	if _, err := svc.Vote(ctx, loved.ID, "", 1); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput without voter, got %v", err)
+	}
+	if _, err := svc.Vote(ctx, 999, "a", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	order := func(sort model.Sort) []int64 {
+		t.Helper()
+		n, err := svc.GetSubtree(ctx, root.ID, sort)
+		if err != nil {
+			t.Fatalf("GetSubtree %s: %v", sort, err)
+		}
+		ids := make([]int64, 0, len(n.Children))
+		for _, ch := range n.Children {
+			ids = append(ids, ch.ID)
+		}
+		return ids
+	}
+	cases := map[model.Sort][]int64{
+		model.SortScoreDesc:     {loved.ID, lone.ID, fresh.ID, split.ID},
+		model.SortBest:          {loved.ID, lone.ID, split.ID, fresh.ID},
+		model.SortControversial: {split.ID, fresh.ID, lone.ID, loved.ID},
+	}
+	for sort, want := range cases {
+		if got := order(sort); !slices.Equal(got, want) {
+			t.Fatalf("%s: expected %v, got %v", sort, want, got)
+		}
+	}
+
+	tp, err := svc.GetTreePage(ctx, "", root.ID, 1, 2, model.SortBest, "")
+	if err != nil {
+		t.Fatalf("GetTreePage best: %v", err)
+	}
+	if len(tp.Items) != 2 || tp.Items[0].ID != loved.ID || tp.NextCursor != "" {
+		t.Fatalf("unexpected best page: %+v", tp)
+	}
+
+	byDate, err := svc.GetTreePage(ctx, "", root.ID, 1, 2, model.SortCreatedAtDesc, "")
+	if err != nil {
+		t.Fatalf("GetTreePage: %v", err)
+	}
+	if _, err := svc.GetTreePage(ctx, "", root.ID, 1, 2, model.SortBest, byDate.NextCursor); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for cursor on vote sort, got %v", err)
+	}
+}
+
+// countingRepo counts the reads that the cache is supposed to absorb.
+type countingRepo struct {
+	*inm.Repo
+	treePages, subtrees int
+}
+
+func (r *countingRepo) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sort model.Sort, cursor *model.Cursor) (model.TreePage, error) {
+	r.treePages++
+	return r.Repo.GetTreePage(ctx, threadKey, parentID, page, limit, sort, cursor)
+}
+
+func (r *countingRepo) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
+	r.subtrees++
+	return r.Repo.GetSubtree(ctx, id, sort)
+}
+
+func newRedisCache(t *testing.T) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	return NewRedisCache(rdb), mr
+}
+
+var cacheBackends = map[string]func(t *testing.T) Cache{
+	"redis": func(t *testing.T) Cache {
+		c, _ := newRedisCache(t)
+		return c
+	},
+	"lru": func(t *testing.T) Cache { return NewLRUCache(100) },
+	"tiered": func(t *testing.T) Cache {
+		c, _ := newRedisCache(t)
+		return NewTieredCache(NewLRUCache(100), c)
+	},
+}
+
+func TestCacheInvalidatesWholeBranch(t *testing.T) {
+	for name, newCache := range cacheBackends {
+		t.Run(name, func(t *testing.T) {
+			repo := &countingRepo{Repo: inm.New()}
+			testCacheInvalidatesWholeBranch(t, New(repo, newCache(t)), repo)
+		})
+	}
+}
+
+func testCacheInvalidatesWholeBranch(t *testing.T, svc CommentService, repo *countingRepo) {
+	ctx := context.Background()
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+	mid, _ := svc.Create(ctx, "", root.ID, "", "mid")
+	leaf, _ := svc.Create(ctx, "", mid.ID, "", "leaf")
+	other, _ := svc.Create(ctx, "t", 0, "", "other")
+
+	subtree := func(id int64) model.CommentNode {
+		t.Helper()
+		n, err := svc.GetSubtree(ctx, id, "")
+		if err != nil {
+			t.Fatalf("GetSubtree %d: %v", id, err)
+		}
+		return n
+	}
+	replies := func(parent int64) model.TreePage {
+		t.Helper()
+		tp, err := svc.GetTreePage(ctx, "", parent, 1, 10, "", "")
+		if err != nil {
+			t.Fatalf("GetTreePage %d: %v", parent, err)
+		}
+		return tp
+	}
+	top := func() model.TreePage {
+		t.Helper()
+		tp, err := svc.GetTreePage(ctx, "t", 0, 1, 10, "", "")
+		if err != nil {
+			t.Fatalf("GetTreePage top: %v", err)
+		}
+		return tp
+	}
+
+	subtree(mid.ID)
+	replies(root.ID)
+	top()
+	subtree(other.ID)
+	subtree(mid.ID)
+	replies(root.ID)
+	top()
+	if repo.subtrees != 2 || repo.treePages != 2 {
+		t.Fatalf("expected repeated reads from cache, got %d subtrees %d pages", repo.subtrees, repo.treePages)
+	}
+
+	// a deep edit must reach every cached view that contains the leaf
+	if _, err := svc.Update(ctx, leaf.ID, "leaf edited"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := subtree(mid.ID).Children[0].Text; got != "leaf edited" {
+		t.Fatalf("stale subtree: %q", got)
+	}
+	if got := replies(root.ID).Items[0].Children[0].Text; got != "leaf edited" {
+		t.Fatalf("stale reply page: %q", got)
+	}
+	var found bool
+	for _, n := range top().Items {
+		if n.ID == root.ID {
+			found = n.Children[0].Children[0].Text == "leaf edited"
+		}
+	}
+	if !found {
+		t.Fatalf("stale top-level page")
+	}
+
+	// other trees keep their entries
+	before := repo.subtrees
+	subtree(other.ID)
+	if repo.subtrees != before {
+		t.Fatalf("expected unrelated tree to stay cached")
+	}
+
+	// moving the leaf across trees refreshes both of them
+	if _, err := svc.Move(ctx, leaf.ID, other.ID); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if n := subtree(mid.ID); len(n.Children) != 0 {
+		t.Fatalf("stale source tree: %+v", n.Children)
+	}
+	if n := subtree(other.ID); len(n.Children) != 1 || n.Children[0].ID != leaf.ID {
+		t.Fatalf("stale target tree: %+v", n.Children)
+	}
+
+	if _, err := svc.DeleteSubtree(ctx, mid.ID); err != nil {
+		t.Fatalf("DeleteSubtree: %v", err)
+	}
+	if tp := replies(root.ID); tp.Total != 0 {
+		t.Fatalf("stale page after delete: %+v", tp.Items)
+	}
+}
+
+func TestCachePurgeBumpsGlobalGeneration(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newRedisCache(t)
+	svc := New(inm.New(), cache)
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+	child, _ := svc.Create(ctx, "", root.ID, "", "child")
+	if _, err := svc.SoftDelete(ctx, child.ID, ""); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+	if n, _ := svc.GetSubtree(ctx, root.ID, ""); len(n.Children) != 1 {
+		t.Fatalf("expected tombstone in subtree, got %+v", n.Children)
+	}
+
+	if _, err := svc.PurgeDeleted(ctx, 0); err != nil {
+		t.Fatalf("PurgeDeleted: %v", err)
+	}
+	if n, _ := svc.GetSubtree(ctx, root.ID, ""); len(n.Children) != 0 {
+		t.Fatalf("expected purge to invalidate cache, got %+v", n.Children)
+	}
+	if v, err := mr.Get("gen:global"); err != nil || v != "1" {
+		t.Fatalf("expected global generation 1, got %q %v", v, err)
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newRedisCache(t)
+	repo := &countingRepo{Repo: inm.New()}
+	svc := New(repo, cache)
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+	for range 2 {
+		if _, err := svc.GetSubtree(ctx, root.ID, ""); err != nil {
+			t.Fatalf("GetSubtree: %v", err)
+		}
+	}
+	if n := repo.subtrees; n != 1 {
+		t.Fatalf("expected the second read cached, got %d loads", n)
+	}
+
+	if err := svc.FlushCache(ctx); err != nil {
+		t.Fatalf("FlushCache: %v", err)
+	}
+	if _, err := svc.GetSubtree(ctx, root.ID, ""); err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	if n := repo.subtrees; n != 2 {
+		t.Fatalf("expected a load after flush, got %d loads", n)
+	}
+	if v, err := mr.Get("gen:global"); err != nil || v != "1" {
+		t.Fatalf("expected global generation 1, got %q %v", v, err)
+	}
+}
+
+func TestLRUCacheBounds(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(2)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Set(ctx, "a", []byte("1"), time.Minute)
+	c.Set(ctx, "b", []byte("2"), time.Second)
+	c.Get(ctx, "a")
+	c.Set(ctx, "c", []byte("3"), time.Minute)
+	if _, ok := c.Get(ctx, "b"); ok {
+		t.Fatalf("expected least recently used entry to be evicted")
+	}
+	if v, ok := c.Get(ctx, "a"); !ok || string(v) != "1" {
+		t.Fatalf("expected a to stay, got %q %v", v, ok)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get(ctx, "c"); ok {
+		t.Fatalf("expected expired entry to be gone")
+	}
+
+	// forgetting a counter must not bring it back to a value already used
+	_ = c.Bump(ctx, "g1")
+	_ = c.Bump(ctx, "g1")
+	_ = c.Bump(ctx, "g2", "g3")
+	gens, _ := c.Generations(ctx, "g1", "g2", "g3")
+	if len(c.gens) > 2 {
+		t.Fatalf("expected at most 2 counters, got %d", len(c.gens))
+	}
+	for i, g := range gens {
+		if g < []int64{2, 1, 1}[i] {
+			t.Fatalf("counter %d went back to %d", i+1, g)
+		}
+	}
+}
+
+// gatedRepo holds subtree reads until the gate opens.
+type gatedRepo struct {
+	*inm.Repo
+	gate     chan struct{}
+	subtrees atomic.Int64
+}
+
+func (r *gatedRepo) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
+	r.subtrees.Add(1)
+	<-r.gate
+	return r.Repo.GetSubtree(ctx, id, sort)
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	ctx := context.Background()
+	repo := &gatedRepo{Repo: inm.New(), gate: make(chan struct{})}
+	svc := New(repo, NewLRUCache(100))
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := svc.GetSubtree(ctx, root.ID, "")
+			if err == nil && n.ID != root.ID {
+				err = errors.New("wrong subtree " + strconv.FormatInt(n.ID, 10))
+			}
+			errs <- err
+		}()
+	}
+
+	for repo.subtrees.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// let the rest of the callers line up behind the first load
+	time.Sleep(50 * time.Millisecond)
+	close(repo.gate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("GetSubtree: %v", err)
+		}
+	}
+	if n := repo.subtrees.Load(); n != 1 {
+		t.Fatalf("expected one repo read for concurrent misses, got %d", n)
+	}
+}
+
+func TestCacheMissReturnsWhenCallerGivesUp(t *testing.T) {
+	ctx := context.Background()
+	repo := &gatedRepo{Repo: inm.New(), gate: make(chan struct{})}
+	svc := New(repo, NewLRUCache(100))
+
+	root, _ := svc.Create(ctx, "t", 0, "", "root")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.GetSubtree(ctx, root.ID, "")
+		done <- err
+	}()
+	for repo.subtrees.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a caller that joins the hung load leaves as soon as its request ends
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := svc.GetSubtree(short, root.ID, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the caller's deadline, got %v", err)
+	}
+
+	close(repo.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	if n := repo.subtrees.Load(); n != 1 {
+		t.Fatalf("expected the load to be shared, got %d reads", n)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+	repo := inm.New()
+	svc := New(repo, NewLRUCache(100), WithCacheTTL(10*time.Millisecond), WithStaleWhileRevalidate(time.Minute))
+
+	root, _ := svc.Create(ctx, "t", 0, "", "before")
+	if n, _ := svc.GetSubtree(ctx, root.ID, ""); n.Text != "before" {
+		t.Fatalf("unexpected subtree %+v", n.Comment)
+	}
+
+	// behind the service's back, so no generation changes
+	if _, err := repo.Update(ctx, root.ID, "after"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	n, err := svc.GetSubtree(ctx, root.ID, "")
+	if err != nil {
+		t.Fatalf("GetSubtree: %v", err)
+	}
+	if n.Text != "before" {
+		t.Fatalf("expected stale entry to be served, got %q", n.Text)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for n.Text != "after" {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale entry was not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+		n, _ = svc.GetSubtree(ctx, root.ID, "")
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traced opens a span around every service call. Cache and repository spans
+// started underneath become its children.
+type traced struct {
+	next   CommentService
+	tracer trace.Tracer
+}
+
+// Trace wraps svc so that each method runs in a "service.<Method>" span.
+func Trace(svc CommentService, tp trace.TracerProvider) CommentService {
+	return &traced{next: svc, tracer: tp.Tracer("github.com/MyNameIsWhaaat/commenttree/internal/comment/service")}
+}
+
+func (s *traced) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "service."+method, trace.WithAttributes(attrs...))
+}
+
+func finish(span trace.Span, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInvalidInput), errors.Is(err, ErrNotFound), errors.Is(err, ErrForbidden):
+		// the caller's mistake, not a failure of the service
+		span.SetAttributes(attribute.String("error.reason", err.Error()))
+	default:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *traced) Create(ctx context.Context, threadKey string, parentID int64, lang model.Language, text string) (model.Comment, error) {
+	ctx, span := s.start(ctx, "Create", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.parent_id", parentID), attribute.String("lang", string(lang)))
+	v, err := s.next.Create(ctx, threadKey, parentID, lang, text)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) Update(ctx context.Context, id int64, text string) (model.Comment, error) {
+	ctx, span := s.start(ctx, "Update", attribute.Int64("comment.id", id))
+	v, err := s.next.Update(ctx, id, text)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error) {
+	ctx, span := s.start(ctx, "GetRevisions", attribute.Int64("comment.id", id))
+	v, err := s.next.GetRevisions(ctx, id)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sort model.Sort, cursor string) (model.TreePage, error) {
+	ctx, span := s.start(ctx, "GetTreePage", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.parent_id", parentID), attribute.Int("page", page), attribute.Int("limit", limit), attribute.String("sort", string(sort)), attribute.Bool("cursor", cursor != ""))
+	v, err := s.next.GetTreePage(ctx, threadKey, parentID, page, limit, sort, cursor)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) DeleteSubtree(ctx context.Context, id int64) (int, error) {
+	ctx, span := s.start(ctx, "DeleteSubtree", attribute.Int64("comment.id", id))
+	v, err := s.next.DeleteSubtree(ctx, id)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error) {
+	ctx, span := s.start(ctx, "SoftDelete", attribute.Int64("comment.id", id))
+	v, err := s.next.SoftDelete(ctx, id, by)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) Restore(ctx context.Context, id int64) (model.Comment, error) {
+	ctx, span := s.start(ctx, "Restore", attribute.Int64("comment.id", id))
+	v, err := s.next.Restore(ctx, id)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) Move(ctx context.Context, id, newParentID int64) (model.Comment, error) {
+	ctx, span := s.start(ctx, "Move", attribute.Int64("comment.id", id), attribute.Int64("comment.parent_id", newParentID))
+	v, err := s.next.Move(ctx, id, newParentID)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error) {
+	ctx, span := s.start(ctx, "Vote", attribute.Int64("comment.id", id), attribute.Int("vote.value", value))
+	v, err := s.next.Vote(ctx, id, voter, value)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) PurgeDeleted(ctx context.Context, retention time.Duration) (int, error) {
+	ctx, span := s.start(ctx, "PurgeDeleted", attribute.String("retention", retention.String()))
+	v, err := s.next.PurgeDeleted(ctx, retention)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) Stats(ctx context.Context, top int) (model.Stats, error) {
+	ctx, span := s.start(ctx, "Stats", attribute.Int("top", top))
+	v, err := s.next.Stats(ctx, top)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) FlushCache(ctx context.Context) error {
+	ctx, span := s.start(ctx, "FlushCache")
+	err := s.next.FlushCache(ctx)
+	finish(span, err)
+	return err
+}
+
+func (s *traced) Export(ctx context.Context, threadKey string, rootID int64, format Format, w io.Writer) error {
+	ctx, span := s.start(ctx, "Export", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.id", rootID), attribute.String("format", string(format)))
+	err := s.next.Export(ctx, threadKey, rootID, format, w)
+	finish(span, err)
+	return err
+}
+
+func (s *traced) Import(ctx context.Context, threadKey string, parentID int64, format Format, r io.Reader) (model.ImportResult, error) {
+	ctx, span := s.start(ctx, "Import", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.parent_id", parentID), attribute.String("format", string(format)))
+	v, err := s.next.Import(ctx, threadKey, parentID, format, r)
+	span.SetAttributes(attribute.Int("imported", v.Imported))
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) CheckIntegrity(ctx context.Context, repair string) (model.IntegrityReport, error) {
+	ctx, span := s.start(ctx, "CheckIntegrity", attribute.String("repair", repair))
+	v, err := s.next.CheckIntegrity(ctx, repair)
+	span.SetAttributes(attribute.Int("checked", v.Checked), attribute.Bool("ok", v.OK()))
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sort model.Sort, cursor string) (model.SearchPage, error) {
+	ctx, span := s.start(ctx, "Search", attribute.String("comment.thread_key", threadKey), attribute.String("lang", string(lang)), attribute.Int("page", page), attribute.Int("limit", limit), attribute.String("sort", string(sort)), attribute.Bool("cursor", cursor != ""))
+	v, err := s.next.Search(ctx, threadKey, q, lang, page, limit, sort, cursor)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
+	ctx, span := s.start(ctx, "GetPath", attribute.Int64("comment.id", id))
+	v, err := s.next.GetPath(ctx, id)
+	finish(span, err)
+	return v, err
+}
+
+func (s *traced) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
+	ctx, span := s.start(ctx, "GetSubtree", attribute.Int64("comment.id", id), attribute.String("sort", string(sort)))
+	v, err := s.next.GetSubtree(ctx, id, sort)
+	finish(span, err)
+	return v, err
+}
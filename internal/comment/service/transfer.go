@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage"
+)
+
+// Format is the encoding of exports and imports.
+type Format string
+
+const (
+	// FormatJSON is nested: one CommentNode for a subtree, an array of them
+	// for a thread.
+	FormatJSON Format = "json"
+	// FormatNDJSON is one Comment per line, parents before their replies.
+	FormatNDJSON Format = "ndjson"
+)
+
+func validateFormat(f Format) error {
+	if f != FormatJSON && f != FormatNDJSON {
+		return invalid("format", CodeInvalidFormat, "must be json or ndjson")
+	}
+	return nil
+}
+
+// Export writes the subtree of rootID, or the whole thread threadKey when
+// rootID is 0, to w. NDJSON is streamed as it is read; nested JSON is built
+// in memory first. Soft-deleted comments keep their place; their text is
+// hidden as in the API, except from admins and trusted code, whose exports
+// an import restores in full.
+func (s *commentService) Export(ctx context.Context, threadKey string, rootID int64, format Format, w io.Writer) error {
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	if rootID < 0 {
+		return invalid("root", CodeInvalidID, "must be a positive integer")
+	}
+	if rootID > 0 {
+		threadKey = ""
+		ok, err := s.repo.Exists(ctx, rootID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNotFound
+		}
+	} else if err := validateThreadKey(threadKey); err != nil {
+		return err
+	}
+
+	a, ok := ActorFrom(ctx)
+	reveal := !ok || a.Admin
+
+	if format == FormatNDJSON {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		err := s.repo.Export(ctx, threadKey, rootID, func(c model.Comment) error {
+			if c.DeletedAt != nil && !reveal {
+				c.Text = model.DeletedText
+			}
+			return enc.Encode(c)
+		})
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	var roots []*nodePtr
+	nodes := make(map[int64]*nodePtr)
+	err := s.repo.Export(ctx, threadKey, rootID, func(c model.Comment) error {
+		n := &nodePtr{c: c}
+		nodes[c.ID] = n
+		if p, ok := nodes[c.ParentID]; ok {
+			p.children = append(p.children, n)
+		} else {
+			roots = append(roots, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	if rootID > 0 {
+		if len(roots) == 0 {
+			return ErrNotFound
+		}
+		n := roots[0].value()
+		if !reveal {
+			renderTombstone(&n)
+		}
+		return enc.Encode(n)
+	}
+	out := make([]model.CommentNode, 0, len(roots))
+	for _, r := range roots {
+		out = append(out, r.value())
+	}
+	if !reveal {
+		renderTombstones(out)
+	}
+	return enc.Encode(out)
+}
+
+// nodePtr builds a tree from comments listed parents first.
+type nodePtr struct {
+	c        model.Comment
+	children []*nodePtr
+}
+
+func (n *nodePtr) value() model.CommentNode {
+	out := model.CommentNode{Comment: n.c, Children: make([]model.CommentNode, 0, len(n.children))}
+	for _, ch := range n.children {
+		out.Children = append(out.Children, ch.value())
+	}
+	return out
+}
+
+// Import recreates exported comments under parentID, or as top-level
+// comments when parentID is 0: in threadKey if given, otherwise in the thread
+// they were exported from. Comments get new ids. Authors, created_at, edit
+// and deletion marks and languages are kept. Votes and revisions are not.
+// The first comment's parent marks the top of the import, every other
+// comment must follow its parent. Only admins may import, since an import
+// sets authors.
+func (s *commentService) Import(ctx context.Context, threadKey string, parentID int64, format Format, r io.Reader) (model.ImportResult, error) {
+	if err := validateFormat(format); err != nil {
+		return model.ImportResult{}, err
+	}
+	if parentID < 0 {
+		return model.ImportResult{}, invalid("parent_id", CodeInvalidParent, "must not be negative")
+	}
+	if a, ok := ActorFrom(ctx); ok && !a.Admin {
+		return model.ImportResult{}, ErrForbidden
+	}
+	if parentID > 0 {
+		threadKey = ""
+		ok, err := s.repo.Exists(ctx, parentID)
+		if err != nil {
+			return model.ImportResult{}, err
+		}
+		if !ok {
+			return model.ImportResult{}, ErrNotFound
+		}
+	} else if threadKey != "" {
+		if err := validateThreadKey(threadKey); err != nil {
+			return model.ImportResult{}, err
+		}
+	}
+
+	var records iter.Seq2[model.Comment, error]
+	if format == FormatNDJSON {
+		records = decodeNDJSON(r)
+	} else {
+		records = decodeNested(r)
+	}
+
+	res, err := s.repo.Import(ctx, parentID, checkImport(records, threadKey, parentID, s.lang))
+	if errors.Is(err, storage.ErrParentNotFound) {
+		return model.ImportResult{}, ErrNotFound
+	}
+	if err != nil {
+		return model.ImportResult{}, err
+	}
+
+	if res.Imported > 0 {
+		if parentID > 0 {
+			s.invalidateBranch(ctx, res.ThreadKey, s.branchPath(ctx, parentID))
+		} else {
+			_ = s.cache.Bump(ctx, genThreadKey(res.ThreadKey))
+			s.metrics.invalidated("thread")
+		}
+	}
+	return res, nil
+}
+
+// checkImport validates records and points the top of the import at its
+// destination thread. Records without a language get lang.
+func checkImport(records iter.Seq2[model.Comment, error], threadKey string, parentID int64, lang model.Language) iter.Seq2[model.Comment, error] {
+	return func(yield func(model.Comment, error) bool) {
+		seen := make(map[int64]bool)
+		var top int64
+		n := 0
+		for c, err := range records {
+			n++
+			if err == nil {
+				err = checkRecord(c, seen, n == 1, top)
+			}
+			if err != nil {
+				yield(model.Comment{}, atRecord(n, err))
+				return
+			}
+
+			if n == 1 {
+				top = c.ParentID
+				if parentID == 0 && threadKey == "" {
+					threadKey = c.ThreadKey
+				}
+			}
+			if !seen[c.ParentID] {
+				if parentID == 0 {
+					if err := validateThreadKey(threadKey); err != nil {
+						yield(model.Comment{}, atRecord(n, err))
+						return
+					}
+				}
+				c.ThreadKey = threadKey
+			}
+			if c.Lang == "" {
+				c.Lang = lang
+			}
+			seen[c.ID] = true
+			if !yield(c, nil) {
+				return
+			}
+		}
+	}
+}
+
+func checkRecord(c model.Comment, seen map[int64]bool, first bool, top int64) error {
+	if c.ID <= 0 {
+		return invalid("id", CodeInvalidID, "must be a positive integer")
+	}
+	if seen[c.ID] {
+		return invalid("id", CodeInvalidID, fmt.Sprintf("id %d appears twice", c.ID))
+	}
+	if !first && !seen[c.ParentID] && c.ParentID != top {
+		return invalid("parent_id", CodeInvalidParent, fmt.Sprintf("parent %d must come before its replies", c.ParentID))
+	}
+	if c.Lang != "" {
+		if err := validateLanguage(c.Lang); err != nil {
+			return err
+		}
+	}
+	if c.DeletedAt == nil {
+		return validateText(c.Text)
+	}
+	return nil
+}
+
+// atRecord tells which input record a validation error is about.
+func atRecord(n int, err error) error {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return invalid(ve.Field, ve.Code, fmt.Sprintf("record %d: %s", n, ve.Message))
+	}
+	return err
+}
+
+func decodeNDJSON(r io.Reader) iter.Seq2[model.Comment, error] {
+	return func(yield func(model.Comment, error) bool) {
+		dec := json.NewDecoder(r)
+		for {
+			var c model.Comment
+			err := dec.Decode(&c)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(model.Comment{}, invalid("body", CodeInvalidRecord, "not a JSON comment"))
+				return
+			}
+			if !yield(c, nil) {
+				return
+			}
+		}
+	}
+}
+
+// decodeNested reads one CommentNode or an array of them and lists the
+// comments parents first.
+func decodeNested(r io.Reader) iter.Seq2[model.Comment, error] {
+	return func(yield func(model.Comment, error) bool) {
+		var raw json.RawMessage
+		if err := json.NewDecoder(r).Decode(&raw); err != nil {
+			yield(model.Comment{}, invalid("body", CodeInvalidRecord, "not a JSON comment tree"))
+			return
+		}
+
+		var nodes []model.CommentNode
+		var err error
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(raw, &nodes)
+		} else {
+			nodes = make([]model.CommentNode, 1)
+			err = json.Unmarshal(raw, &nodes[0])
+		}
+		if err != nil {
+			yield(model.Comment{}, invalid("body", CodeInvalidRecord, "not a JSON comment tree"))
+			return
+		}
+
+		// breadth first, which keeps the order of an NDJSON export
+		for len(nodes) > 0 {
+			var next []model.CommentNode
+			for _, n := range nodes {
+				if !yield(n.Comment, nil) {
+					return
+				}
+				next = append(next, n.Children...)
+			}
+			nodes = next
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package storage
+
+import "errors"
+
+var (
+	// ErrParentNotFound is returned when a comment is created or imported
+	// under a parent that does not exist, including one deleted concurrently.
+	ErrParentNotFound = errors.New("parent comment not found")
+	// ErrCycle is returned when a comment would be moved under one of its own
+	// descendants.
+	ErrCycle = errors.New("target parent is inside the moved subtree")
+	// ErrThreadMismatch is returned when a comment would be moved under a
+	// parent that belongs to another thread.
+	ErrThreadMismatch = errors.New("target parent belongs to another thread")
+)
@@ -2,26 +2,37 @@ package inmemory
 
 import (
 	"context"
+	"database/sql"
+	"iter"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage"
 )
 
 type Repo struct {
 	mu sync.RWMutex
 
-	nextID   int64
-	byID     map[int64]model.Comment
-	children map[int64][]int64
+	nextID    int64
+	nextRevID int64
+	byID      map[int64]model.Comment
+	children  map[int64][]int64
+	revisions map[int64][]model.CommentRevision
+	votes     map[int64]map[string]int
 }
 
 func New() *Repo {
 	return &Repo{
-		nextID:   1,
-		byID:     make(map[int64]model.Comment),
-		children: make(map[int64][]int64),
+		nextID:    1,
+		nextRevID: 1,
+		byID:      make(map[int64]model.Comment),
+		children:  make(map[int64][]int64),
+		revisions: make(map[int64][]model.CommentRevision),
+		votes:     make(map[int64]map[string]int),
 	}
 }
 
@@ -33,16 +44,38 @@ func (r *Repo) Exists(ctx context.Context, id int64) (bool, error) {
 	return ok, nil
 }
 
-func (r *Repo) Create(ctx context.Context, parentID int64, text string) (model.Comment, error) {
+func (r *Repo) Get(ctx context.Context, id int64) (model.Comment, error) {
+	_ = ctx
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.byID[id]
+	if !ok {
+		return model.Comment{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (r *Repo) Create(ctx context.Context, threadKey string, parentID int64, author model.Author, lang model.Language, text string) (model.Comment, error) {
 	_ = ctx
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if parentID != 0 {
+		parent, ok := r.byID[parentID]
+		if !ok {
+			return model.Comment{}, storage.ErrParentNotFound
+		}
+		threadKey = parent.ThreadKey
+	}
+
 	c := model.Comment{
 		ID:        r.nextID,
 		ParentID:  parentID,
+		ThreadKey: threadKey,
+		Author:    author,
 		Text:      text,
+		Lang:      lang,
 		CreatedAt: time.Now().UTC(),
 	}
 	r.nextID++
@@ -53,32 +86,65 @@ func (r *Repo) Create(ctx context.Context, parentID int64, text string) (model.C
 	return c, nil
 }
 
-func (r *Repo) GetTreePage(ctx context.Context, parentID int64, page, limit int, sortMode model.Sort) (model.TreePage, error) {
+func (r *Repo) Update(ctx context.Context, id int64, text string) (model.Comment, error) {
 	_ = ctx
 
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	childIDs := append([]int64(nil), r.children[parentID]...)
-	total := len(childIDs)
+	c, ok := r.byID[id]
+	if !ok || c.DeletedAt != nil {
+		return model.Comment{}, sql.ErrNoRows
+	}
 
-	sort.Slice(childIDs, func(i, j int) bool {
-		a := r.byID[childIDs[i]].CreatedAt
-		b := r.byID[childIDs[j]].CreatedAt
-		if sortMode == model.SortCreatedAtAsc {
-			return a.Before(b)
-		}
-		return a.After(b)
+	now := time.Now().UTC()
+	r.revisions[id] = append(r.revisions[id], model.CommentRevision{
+		ID:        r.nextRevID,
+		CommentID: id,
+		Text:      c.Text,
+		CreatedAt: now,
 	})
+	r.nextRevID++
+
+	c.Text = text
+	c.EditedAt = &now
+	r.byID[id] = c
+
+	return c, nil
+}
 
-	start := (page - 1) * limit
-	if start > total {
-		start = total
+func (r *Repo) GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error) {
+	_ = ctx
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.byID[id]; !ok {
+		return nil, sql.ErrNoRows
 	}
-	end := start + limit
-	if end > total {
-		end = total
+	return append([]model.CommentRevision{}, r.revisions[id]...), nil
+}
+
+func (r *Repo) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sortMode model.Sort, cursor *model.Cursor) (model.TreePage, error) {
+	_ = ctx
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	childIDs := make([]int64, 0, len(r.children[parentID]))
+	for _, id := range r.children[parentID] {
+		if threadKey == "" || r.byID[id].ThreadKey == threadKey {
+			childIDs = append(childIDs, id)
+		}
 	}
+	total := len(childIDs)
+
+	r.sortIDsLocked(childIDs, sortMode)
+
+	start, end := pageWindow(total, page, limit, cursor, func(i int) int {
+		c := r.byID[childIDs[i]]
+		return compareKey(c.CreatedAt, 0, c.ID, cursor, sortMode)
+	})
 	pageIDs := childIDs[start:end]
 
 	items := make([]model.CommentNode, 0, len(pageIDs))
@@ -86,26 +152,31 @@ func (r *Repo) GetTreePage(ctx context.Context, parentID int64, page, limit int,
 		items = append(items, r.buildNodeLocked(id, sortMode))
 	}
 
-	return model.TreePage{
+	tp := model.TreePage{
 		Items: items,
 		Page:  page,
 		Limit: limit,
 		Total: total,
-	}, nil
+	}
+	if sortMode.ByVotes() {
+		return tp, nil
+	}
+	if start > 0 && start < end {
+		first := r.byID[childIDs[start]]
+		tp.PrevCursor = model.Cursor{Sort: sortMode, CreatedAt: first.CreatedAt, ID: first.ID, Backward: true}.Encode()
+	}
+	if end < total && start < end {
+		last := r.byID[childIDs[end-1]]
+		tp.NextCursor = model.Cursor{Sort: sortMode, CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	return tp, nil
 }
 
 func (r *Repo) buildNodeLocked(id int64, sortMode model.Sort) model.CommentNode {
 	c := r.byID[id]
 	childIDs := append([]int64(nil), r.children[id]...)
 
-	sort.Slice(childIDs, func(i, j int) bool {
-		a := r.byID[childIDs[i]].CreatedAt
-		b := r.byID[childIDs[j]].CreatedAt
-		if sortMode == model.SortCreatedAtAsc {
-			return a.Before(b)
-		}
-		return a.After(b)
-	})
+	r.sortIDsLocked(childIDs, sortMode)
 
 	children := make([]model.CommentNode, 0, len(childIDs))
 	for _, cid := range childIDs {
@@ -118,6 +189,174 @@ func (r *Repo) buildNodeLocked(id int64, sortMode model.Sort) model.CommentNode
 	}
 }
 
+func (r *Repo) sortIDsLocked(ids []int64, sortMode model.Sort) {
+	sort.Slice(ids, func(i, j int) bool {
+		return sortMode.Less(r.byID[ids[i]], r.byID[ids[j]])
+	})
+}
+
+func (r *Repo) GetSubtree(ctx context.Context, id int64, sortMode model.Sort) (model.CommentNode, error) {
+	_ = ctx
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.byID[id]; !ok {
+		return model.CommentNode{}, sql.ErrNoRows
+	}
+	return r.buildNodeLocked(id, sortMode), nil
+}
+
+func (r *Repo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
+	_ = ctx
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var items []model.CommentPathItem
+	for cur := id; cur != 0; {
+		c, ok := r.byID[cur]
+		if !ok {
+			break
+		}
+		items = append(items, model.CommentPathItem{
+			ID:       c.ID,
+			ParentID: c.ParentID,
+			Text:     c.Text,
+			Deleted:  c.DeletedAt != nil,
+		})
+		cur = c.ParentID
+	}
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+
+	return items, nil
+}
+
+// Search mimics plainto_tsquery matching: every query token must appear in
+// the comment text. Rank is the share of text tokens hit by the query and
+// the snippet is the whole text with matches wrapped in <mark>, like
+// ts_headline with HighlightAll=true. No language is stemmed here, so lang
+// changes nothing: every comment matches as if it were simple.
+func (r *Repo) Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sortMode model.Sort, cursor *model.Cursor) (model.SearchPage, error) {
+	_ = ctx
+
+	terms := tokenize(q)
+	if len(terms) == 0 {
+		return model.SearchPage{Items: []model.SearchItem{}, Page: page, Limit: limit}, nil
+	}
+
+	r.mu.RLock()
+	found := make([]model.SearchItem, 0, 16)
+	for _, c := range r.byID {
+		if c.DeletedAt != nil || (threadKey != "" && c.ThreadKey != threadKey) {
+			continue
+		}
+		rank, ok := matchTerms(c.Text, terms)
+		if !ok {
+			continue
+		}
+		found = append(found, model.SearchItem{
+			ID:        c.ID,
+			ParentID:  c.ParentID,
+			ThreadKey: c.ThreadKey,
+			Author:    c.Author,
+			Snippet:   highlight(c.Text, terms),
+			Rank:      rank,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		switch sortMode {
+		case model.SortCreatedAtAsc:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		case model.SortCreatedAtDesc:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+		default:
+			if a.Rank != b.Rank {
+				return a.Rank > b.Rank
+			}
+		}
+		if sortMode == model.SortCreatedAtAsc {
+			return a.ID < b.ID
+		}
+		return a.ID > b.ID
+	})
+
+	total := len(found)
+	start, end := pageWindow(total, page, limit, cursor, func(i int) int {
+		return compareKey(found[i].CreatedAt, found[i].Rank, found[i].ID, cursor, sortMode)
+	})
+
+	sp := model.SearchPage{
+		Items: append([]model.SearchItem{}, found[start:end]...),
+		Page:  page,
+		Limit: limit,
+		Total: total,
+	}
+	if start > 0 && start < end {
+		first := found[start]
+		sp.PrevCursor = model.Cursor{Sort: sortMode, CreatedAt: first.CreatedAt, Rank: first.Rank, ID: first.ID, Backward: true}.Encode()
+	}
+	if end < total && start < end {
+		last := found[end-1]
+		sp.NextCursor = model.Cursor{Sort: sortMode, CreatedAt: last.CreatedAt, Rank: last.Rank, ID: last.ID}.Encode()
+	}
+	return sp, nil
+}
+
+// Vote records voter's vote on comment id, replacing an earlier one; value 0
+// takes the vote back. Tombstones cannot be voted on.
+func (r *Repo) Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error) {
+	_ = ctx
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byID[id]
+	if !ok || c.DeletedAt != nil {
+		return model.Comment{}, sql.ErrNoRows
+	}
+
+	votes := r.votes[id]
+	if votes == nil {
+		votes = make(map[string]int)
+		r.votes[id] = votes
+	}
+	switch votes[voter] {
+	case 1:
+		c.Upvotes--
+	case -1:
+		c.Downvotes--
+	}
+	switch value {
+	case 1:
+		c.Upvotes++
+		votes[voter] = value
+	case -1:
+		c.Downvotes++
+		votes[voter] = value
+	default:
+		delete(votes, voter)
+	}
+	c.Score = c.Upvotes - c.Downvotes
+	r.byID[id] = c
+
+	return c, nil
+}
+
 func (r *Repo) DeleteSubtree(ctx context.Context, id int64) (int, error) {
 	_ = ctx
 
@@ -146,11 +385,321 @@ func (r *Repo) DeleteSubtree(ctx context.Context, id int64) (int, error) {
 
 		delete(r.byID, cid)
 		delete(r.children, cid)
+		delete(r.revisions, cid)
+		delete(r.votes, cid)
 	}
 
 	return len(toDelete), nil
 }
 
+func (r *Repo) SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error) {
+	_ = ctx
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byID[id]
+	if !ok {
+		return model.Comment{}, sql.ErrNoRows
+	}
+	if c.DeletedAt == nil {
+		now := time.Now().UTC()
+		c.DeletedAt = &now
+		c.DeletedBy = by
+		r.byID[id] = c
+	}
+	return c, nil
+}
+
+func (r *Repo) Restore(ctx context.Context, id int64) (model.Comment, error) {
+	_ = ctx
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byID[id]
+	if !ok {
+		return model.Comment{}, sql.ErrNoRows
+	}
+	c.DeletedAt = nil
+	c.DeletedBy = ""
+	r.byID[id] = c
+	return c, nil
+}
+
+func (r *Repo) Move(ctx context.Context, id, newParentID int64) (model.Comment, error) {
+	_ = ctx
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byID[id]
+	if !ok {
+		return model.Comment{}, sql.ErrNoRows
+	}
+	if newParentID != 0 {
+		parent, ok := r.byID[newParentID]
+		if !ok {
+			return model.Comment{}, sql.ErrNoRows
+		}
+		if parent.ThreadKey != c.ThreadKey {
+			return model.Comment{}, storage.ErrThreadMismatch
+		}
+	}
+
+	for cur := newParentID; cur != 0; cur = r.byID[cur].ParentID {
+		if cur == id {
+			return model.Comment{}, storage.ErrCycle
+		}
+	}
+
+	if c.ParentID == newParentID {
+		return c, nil
+	}
+
+	r.children[c.ParentID] = removeID(r.children[c.ParentID], id)
+	r.children[newParentID] = append(r.children[newParentID], id)
+	c.ParentID = newParentID
+	r.byID[id] = c
+
+	return c, nil
+}
+
+// PurgeDeleted removes tombstones deleted before the cutoff, leaves first, so
+// that a tombstone goes only once nothing but purged tombstones remain below it.
+func (r *Repo) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	_ = ctx
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	purged := 0
+	for {
+		var leaves []int64
+		for id, c := range r.byID {
+			if c.DeletedAt != nil && c.DeletedAt.Before(before) && len(r.children[id]) == 0 {
+				leaves = append(leaves, id)
+			}
+		}
+		if len(leaves) == 0 {
+			return purged, nil
+		}
+
+		for _, id := range leaves {
+			parent := r.byID[id].ParentID
+			r.children[parent] = removeID(r.children[parent], id)
+
+			delete(r.byID, id)
+			delete(r.children, id)
+			delete(r.revisions, id)
+			delete(r.votes, id)
+		}
+		purged += len(leaves)
+	}
+}
+
+func (r *Repo) Stats(ctx context.Context, top int) (model.Stats, error) {
+	_ = ctx
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	st := model.Stats{TopThreads: []model.ThreadStats{}}
+	perThread := map[string]int{}
+	for _, c := range r.byID {
+		st.Comments++
+		if c.DeletedAt != nil {
+			st.Deleted++
+		}
+		perThread[c.ThreadKey]++
+
+		st.MaxDepth = max(st.MaxDepth, r.depthLocked(c))
+	}
+
+	st.Threads = len(perThread)
+	for k, n := range perThread {
+		st.TopThreads = append(st.TopThreads, model.ThreadStats{ThreadKey: k, Comments: n})
+	}
+	sort.Slice(st.TopThreads, func(i, j int) bool {
+		a, b := st.TopThreads[i], st.TopThreads[j]
+		if a.Comments != b.Comments {
+			return a.Comments > b.Comments
+		}
+		return a.ThreadKey < b.ThreadKey
+	})
+	if len(st.TopThreads) > top {
+		st.TopThreads = st.TopThreads[:top]
+	}
+	return st, nil
+}
+
+func (r *Repo) depthLocked(c model.Comment) int {
+	depth := 0
+	for p := c.ParentID; p != 0; p = r.byID[p].ParentID {
+		depth++
+	}
+	return depth
+}
+
+func (r *Repo) Export(ctx context.Context, threadKey string, rootID int64, fn func(model.Comment) error) error {
+	_ = ctx
+
+	type row struct {
+		c     model.Comment
+		depth int
+	}
+
+	// copy under the lock and call fn outside of it
+	r.mu.RLock()
+	var rows []row
+	if rootID > 0 {
+		if _, ok := r.byID[rootID]; ok {
+			stack := []int64{rootID}
+			for len(stack) > 0 {
+				id := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				c := r.byID[id]
+				rows = append(rows, row{c: c, depth: r.depthLocked(c)})
+				stack = append(stack, r.children[id]...)
+			}
+		}
+	} else {
+		for _, c := range r.byID {
+			if c.ThreadKey == threadKey {
+				rows = append(rows, row{c: c, depth: r.depthLocked(c)})
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.depth != b.depth {
+			return a.depth < b.depth
+		}
+		if !a.c.CreatedAt.Equal(b.c.CreatedAt) {
+			return a.c.CreatedAt.Before(b.c.CreatedAt)
+		}
+		return a.c.ID < b.c.ID
+	})
+	for _, row := range rows {
+		if err := fn(row.c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repo) Import(ctx context.Context, parentID int64, comments iter.Seq2[model.Comment, error]) (model.ImportResult, error) {
+	_ = ctx
+
+	// read everything first so that a failing input leaves nothing behind
+	var in []model.Comment
+	for c, err := range comments {
+		if err != nil {
+			return model.ImportResult{}, err
+		}
+		in = append(in, c)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if parentID != 0 {
+		if _, ok := r.byID[parentID]; !ok {
+			return model.ImportResult{}, storage.ErrParentNotFound
+		}
+	}
+
+	res := model.ImportResult{Roots: []int64{}}
+	ids := make(map[int64]int64, len(in))
+	for _, c := range in {
+		parent, ok := ids[c.ParentID]
+		if !ok {
+			parent = parentID
+		}
+		if p, found := r.byID[parent]; found {
+			c.ThreadKey = p.ThreadKey
+		}
+		if c.CreatedAt.IsZero() {
+			c.CreatedAt = time.Now().UTC()
+		}
+
+		src := c.ID
+		c.ID = r.nextID
+		c.ParentID = parent
+		c.Upvotes, c.Downvotes, c.Score = 0, 0, 0
+		r.nextID++
+
+		r.byID[c.ID] = c
+		r.children[parent] = append(r.children[parent], c.ID)
+		ids[src] = c.ID
+		if !ok {
+			res.Roots = append(res.Roots, c.ID)
+			res.ThreadKey = c.ThreadKey
+		}
+		res.Imported++
+	}
+	return res, nil
+}
+
+// ScanTree reports no paths or depths: this storage derives them from the
+// parent links every time.
+func (r *Repo) ScanTree(ctx context.Context, fn func(model.TreeLink) error) error {
+	_ = ctx
+
+	r.mu.RLock()
+	links := make([]model.TreeLink, 0, len(r.byID))
+	for _, c := range r.byID {
+		links = append(links, model.TreeLink{ID: c.ID, ParentID: c.ParentID, ThreadKey: c.ThreadKey, Depth: -1})
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	for _, l := range links {
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repo) Repair(ctx context.Context, reparent map[int64]int64) (int, error) {
+	_ = ctx
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, parentID := range reparent {
+		c, ok := r.byID[id]
+		if !ok {
+			continue
+		}
+		r.children[c.ParentID] = removeID(r.children[c.ParentID], id)
+		r.children[parentID] = append(r.children[parentID], id)
+		c.ParentID = parentID
+		r.byID[id] = c
+	}
+
+	rebuilt := 0
+	var walk func(id int64, threadKey string)
+	walk = func(id int64, threadKey string) {
+		for _, ch := range r.children[id] {
+			c := r.byID[ch]
+			if c.ThreadKey != threadKey {
+				c.ThreadKey = threadKey
+				r.byID[ch] = c
+				rebuilt++
+			}
+			walk(ch, threadKey)
+		}
+	}
+	for _, id := range r.children[0] {
+		walk(id, r.byID[id].ThreadKey)
+	}
+	return rebuilt, nil
+}
+
 func removeID(ids []int64, target int64) []int64 {
 	out := ids[:0]
 	for _, v := range ids {
@@ -160,3 +709,112 @@ func removeID(ids []int64, target int64) []int64 {
 	}
 	return append([]int64(nil), out...)
 }
+
+// compareKey places an item relative to the cursor in sortMode order: negative
+// if it comes before the cursor, zero at the cursor, positive after it.
+func compareKey(createdAt time.Time, rank float64, id int64, cur *model.Cursor, sortMode model.Sort) int {
+	c := 0
+	switch sortMode {
+	case model.SortCreatedAtAsc, model.SortCreatedAtDesc:
+		c = createdAt.Compare(cur.CreatedAt)
+	default:
+		switch {
+		case rank < cur.Rank:
+			c = -1
+		case rank > cur.Rank:
+			c = 1
+		}
+	}
+	if c == 0 {
+		switch {
+		case id < cur.ID:
+			c = -1
+		case id > cur.ID:
+			c = 1
+		}
+	}
+	if sortMode != model.SortCreatedAtAsc {
+		c = -c
+	}
+	return c
+}
+
+// pageWindow picks the [start, end) range of n sorted items for an offset page
+// or, when cur is set, for the limit items after (or before) the cursor.
+// cmp(i) compares item i with the cursor as compareKey does.
+func pageWindow(n, page, limit int, cur *model.Cursor, cmp func(i int) int) (int, int) {
+	if cur == nil {
+		start := (page - 1) * limit
+		if start > n {
+			start = n
+		}
+		return start, min(start+limit, n)
+	}
+	if cur.Backward {
+		end := sort.Search(n, func(i int) bool { return cmp(i) >= 0 })
+		return max(end-limit, 0), end
+	}
+	start := sort.Search(n, func(i int) bool { return cmp(i) > 0 })
+	return start, min(start+limit, n)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !isWordRune(r) })
+}
+
+func matchTerms(text string, terms []string) (float64, bool) {
+	words := tokenize(text)
+	if len(words) == 0 {
+		return 0, false
+	}
+
+	counts := make(map[string]int, len(words))
+	for _, w := range words {
+		counts[w]++
+	}
+
+	hits := 0
+	for _, t := range terms {
+		n, ok := counts[t]
+		if !ok {
+			return 0, false
+		}
+		hits += n
+	}
+	return float64(hits) / float64(len(words)), true
+}
+
+func highlight(text string, terms []string) string {
+	set := make(map[string]struct{}, len(terms))
+	for _, t := range terms {
+		set[t] = struct{}{}
+	}
+
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		if _, ok := set[strings.ToLower(word)]; ok {
+			b.WriteString("<mark>")
+			b.WriteString(word)
+			b.WriteString("</mark>")
+		} else {
+			b.WriteString(word)
+		}
+		i = j
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instrumented times every call of the wrapped repository.
+type instrumented struct {
+	next     Repository
+	duration *prometheus.HistogramVec
+}
+
+// Instrument wraps repo so that each method records its duration in
+// commenttree_repo_query_duration_seconds, labelled by method and outcome.
+func Instrument(repo Repository, reg prometheus.Registerer) Repository {
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "commenttree_repo_query_duration_seconds",
+		Help:    "Duration of repository calls.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"method", "outcome"})
+	reg.MustRegister(duration)
+	return &instrumented{next: repo, duration: duration}
+}
+
+func (r *instrumented) observe(method string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	r.duration.WithLabelValues(method, outcome).Observe(time.Since(start).Seconds())
+}
+
+func (r *instrumented) Create(ctx context.Context, threadKey string, parentID int64, author model.Author, lang model.Language, text string) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.Create(ctx, threadKey, parentID, author, lang, text)
+	r.observe("Create", start, err)
+	return v, err
+}
+
+func (r *instrumented) Update(ctx context.Context, id int64, text string) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.Update(ctx, id, text)
+	r.observe("Update", start, err)
+	return v, err
+}
+
+func (r *instrumented) GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error) {
+	start := time.Now()
+	v, err := r.next.GetRevisions(ctx, id)
+	r.observe("GetRevisions", start, err)
+	return v, err
+}
+
+func (r *instrumented) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sort model.Sort, cursor *model.Cursor) (model.TreePage, error) {
+	start := time.Now()
+	v, err := r.next.GetTreePage(ctx, threadKey, parentID, page, limit, sort, cursor)
+	r.observe("GetTreePage", start, err)
+	return v, err
+}
+
+func (r *instrumented) DeleteSubtree(ctx context.Context, id int64) (int, error) {
+	start := time.Now()
+	v, err := r.next.DeleteSubtree(ctx, id)
+	r.observe("DeleteSubtree", start, err)
+	return v, err
+}
+
+func (r *instrumented) SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.SoftDelete(ctx, id, by)
+	r.observe("SoftDelete", start, err)
+	return v, err
+}
+
+func (r *instrumented) Restore(ctx context.Context, id int64) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.Restore(ctx, id)
+	r.observe("Restore", start, err)
+	return v, err
+}
+
+func (r *instrumented) Move(ctx context.Context, id, newParentID int64) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.Move(ctx, id, newParentID)
+	r.observe("Move", start, err)
+	return v, err
+}
+
+func (r *instrumented) Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.Vote(ctx, id, voter, value)
+	r.observe("Vote", start, err)
+	return v, err
+}
+
+func (r *instrumented) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	start := time.Now()
+	v, err := r.next.PurgeDeleted(ctx, before)
+	r.observe("PurgeDeleted", start, err)
+	return v, err
+}
+
+func (r *instrumented) Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sort model.Sort, cursor *model.Cursor) (model.SearchPage, error) {
+	start := time.Now()
+	v, err := r.next.Search(ctx, threadKey, q, lang, page, limit, sort, cursor)
+	r.observe("Search", start, err)
+	return v, err
+}
+
+func (r *instrumented) Exists(ctx context.Context, id int64) (bool, error) {
+	start := time.Now()
+	v, err := r.next.Exists(ctx, id)
+	r.observe("Exists", start, err)
+	return v, err
+}
+
+func (r *instrumented) Get(ctx context.Context, id int64) (model.Comment, error) {
+	start := time.Now()
+	v, err := r.next.Get(ctx, id)
+	r.observe("Get", start, err)
+	return v, err
+}
+
+func (r *instrumented) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
+	start := time.Now()
+	v, err := r.next.GetSubtree(ctx, id, sort)
+	r.observe("GetSubtree", start, err)
+	return v, err
+}
+
+func (r *instrumented) Stats(ctx context.Context, top int) (model.Stats, error) {
+	start := time.Now()
+	v, err := r.next.Stats(ctx, top)
+	r.observe("Stats", start, err)
+	return v, err
+}
+
+func (r *instrumented) Export(ctx context.Context, threadKey string, rootID int64, fn func(model.Comment) error) error {
+	start := time.Now()
+	err := r.next.Export(ctx, threadKey, rootID, fn)
+	r.observe("Export", start, err)
+	return err
+}
+
+func (r *instrumented) Import(ctx context.Context, parentID int64, comments iter.Seq2[model.Comment, error]) (model.ImportResult, error) {
+	start := time.Now()
+	v, err := r.next.Import(ctx, parentID, comments)
+	r.observe("Import", start, err)
+	return v, err
+}
+
+func (r *instrumented) ScanTree(ctx context.Context, fn func(model.TreeLink) error) error {
+	start := time.Now()
+	err := r.next.ScanTree(ctx, fn)
+	r.observe("ScanTree", start, err)
+	return err
+}
+
+func (r *instrumented) Repair(ctx context.Context, reparent map[int64]int64) (int, error) {
+	start := time.Now()
+	v, err := r.next.Repair(ctx, reparent)
+	r.observe("Repair", start, err)
+	return v, err
+}
+
+func (r *instrumented) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
+	start := time.Now()
+	v, err := r.next.GetPath(ctx, id)
+	r.observe("GetPath", start, err)
+	return v, err
+}
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PoolCollector exports pgxpool statistics, read at scrape time.
+type PoolCollector struct {
+	pool *pgxpool.Pool
+
+	total, idle, acquired, constructing, max  *prometheus.Desc
+	acquires, emptyAcquires, canceledAcquires *prometheus.Desc
+	acquireSeconds                            *prometheus.Desc
+}
+
+func NewPoolCollector(pool *pgxpool.Pool) *PoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("commenttree_pgxpool_"+name, help, nil, nil)
+	}
+	return &PoolCollector{
+		pool:             pool,
+		total:            desc("conns", "Connections currently in the pool."),
+		idle:             desc("idle_conns", "Idle connections."),
+		acquired:         desc("acquired_conns", "Connections checked out by queries."),
+		constructing:     desc("constructing_conns", "Connections being opened."),
+		max:              desc("max_conns", "Maximum pool size."),
+		acquires:         desc("acquires_total", "Successful connection acquires."),
+		emptyAcquires:    desc("empty_acquires_total", "Acquires that had to wait because the pool was empty."),
+		canceledAcquires: desc("canceled_acquires_total", "Acquires canceled by their context."),
+		acquireSeconds:   desc("acquire_duration_seconds_total", "Total time spent waiting for connections."),
+	}
+}
+
+func (c *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.total
+	ch <- c.idle
+	ch <- c.acquired
+	ch <- c.constructing
+	ch <- c.max
+	ch <- c.acquires
+	ch <- c.emptyAcquires
+	ch <- c.canceledAcquires
+	ch <- c.acquireSeconds
+}
+
+func (c *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.pool.Stat()
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+	gauge(c.total, float64(s.TotalConns()))
+	gauge(c.idle, float64(s.IdleConns()))
+	gauge(c.acquired, float64(s.AcquiredConns()))
+	gauge(c.constructing, float64(s.ConstructingConns()))
+	gauge(c.max, float64(s.MaxConns()))
+	counter(c.acquires, float64(s.AcquireCount()))
+	counter(c.emptyAcquires, float64(s.EmptyAcquireCount()))
+	counter(c.canceledAcquires, float64(s.CanceledAcquireCount()))
+	counter(c.acquireSeconds, s.AcquireDuration().Seconds())
+}
@@ -0,0 +1,237 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrateLockKey serializes migrators running against the same database.
+const migrateLockKey = 0x6d696772617465
+
+// Migration is one numbered schema change, read from NNNN_name.up.sql and
+// NNNN_name.down.sql.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies migrations and records the version in schema_migrations,
+// the same table golang-migrate uses, so databases migrated by either tool
+// can be handed over to the other. Every migration runs in a transaction
+// together with its version bump.
+type Migrator struct {
+	db         *pgxpool.Pool
+	migrations []Migration
+}
+
+func NewMigrator(db *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	ms, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: ms}, nil
+}
+
+// LoadMigrations reads the migrations in the root of fsys, ordered by version.
+// Every version needs both an up and a down file.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, name := range names {
+		base, dir, ok := cutDirection(name)
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+		num, label, _ := strings.Cut(base, "_")
+		v, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[v]
+		if m == nil {
+			m = &Migration{Version: v, Name: label}
+			byVersion[v] = m
+		}
+		if dir == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	ms := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d: both up and down files are required", m.Version)
+		}
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+func cutDirection(name string) (base, dir string, ok bool) {
+	name = strings.TrimSuffix(path.Base(name), ".sql")
+	if base, ok = strings.CutSuffix(name, ".up"); ok {
+		return base, "up", true
+	}
+	if base, ok = strings.CutSuffix(name, ".down"); ok {
+		return base, "down", true
+	}
+	return "", "", false
+}
+
+// Version returns the current schema version, 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (version int64, dirty bool, err error) {
+	err = m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err = currentVersion(ctx, conn)
+		return err
+	})
+	return version, dirty, err
+}
+
+// Up applies up to n pending migrations, all of them if n <= 0, and returns
+// the versions applied.
+func (m *Migrator) Up(ctx context.Context, n int) ([]int64, error) {
+	var applied []int64
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		cur, err := cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if mig.Version <= cur {
+				continue
+			}
+			if n > 0 && len(applied) == n {
+				break
+			}
+			if err := apply(ctx, conn, mig.Up, mig.Version); err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig.Version)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts up to n applied migrations, newest first, all of them if
+// n <= 0, and returns the versions reverted.
+func (m *Migrator) Down(ctx context.Context, n int) ([]int64, error) {
+	var reverted []int64
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		cur, err := cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if mig.Version > cur {
+				continue
+			}
+			if n > 0 && len(reverted) == n {
+				break
+			}
+			prev := int64(0)
+			if i > 0 {
+				prev = m.migrations[i-1].Version
+			}
+			if err := apply(ctx, conn, mig.Down, prev); err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", mig.Version, mig.Name, err)
+			}
+			reverted = append(reverted, mig.Version)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func(*pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrateLockKey); err != nil {
+		return err
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrateLockKey)
+
+	if _, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT NOT NULL PRIMARY KEY,
+			dirty   BOOLEAN NOT NULL
+		)`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func currentVersion(ctx context.Context, conn *pgxpool.Conn) (int64, bool, error) {
+	var version int64
+	var dirty bool
+	err := conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// cleanVersion refuses to go on from a migration that failed halfway, which
+// only golang-migrate can leave behind since it does not use transactions.
+func cleanVersion(ctx context.Context, conn *pgxpool.Conn) (int64, error) {
+	version, dirty, err := currentVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema is dirty at version %d, fix it by hand and reset schema_migrations", version)
+	}
+	return version, nil
+}
+
+// apply runs sql and records version in one transaction. Version 0 means no
+// migrations are applied.
+func apply(ctx context.Context, conn *pgxpool.Conn, sql string, version int64) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// without arguments pgx uses the simple protocol, which allows several statements
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return err
+	}
+	if version > 0 {
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
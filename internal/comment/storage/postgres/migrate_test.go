@@ -0,0 +1,41 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/MyNameIsWhaaat/commenttree/migrations"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	ms, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+	if len(ms) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range ms {
+		if m.Version != int64(i+1) {
+			t.Fatalf("expected version %d at %d, got %d_%s", i+1, i, m.Version, m.Name)
+		}
+		// every migration already runs in a transaction of its own
+		for _, body := range []string{m.Up, m.Down} {
+			if strings.Contains(strings.ToUpper(body), "BEGIN;") {
+				t.Fatalf("migration %d_%s manages its own transaction", m.Version, m.Name)
+			}
+		}
+	}
+
+	if _, err := LoadMigrations(fstest.MapFS{
+		"0001_a.up.sql": {Data: []byte("SELECT 1")},
+	}); err == nil {
+		t.Fatal("expected an error for a migration without down")
+	}
+	if _, err := LoadMigrations(fstest.MapFS{
+		"first.up.sql": {Data: []byte("SELECT 1")},
+	}); err == nil {
+		t.Fatal("expected an error for a migration without version")
+	}
+}
@@ -2,11 +2,14 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 	"sort"
 	"time"
 
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/storage"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -48,6 +51,30 @@ func (r *Repo) Close() {
 	}
 }
 
+const commentColumns = `id, parent_id, thread_key, author_id, author_name, text, lang::text, upvotes, downvotes, score, created_at, edited_at, deleted_at, deleted_by`
+
+func scanComment(row pgx.Row, c *model.Comment) error {
+	return row.Scan(
+		&c.ID, &c.ParentID, &c.ThreadKey, &c.Author.ID, &c.Author.Name,
+		&c.Text, &c.Lang, &c.Upvotes, &c.Downvotes, &c.Score,
+		&c.CreatedAt, &c.EditedAt, &c.DeletedAt, &c.DeletedBy,
+	)
+}
+
+// voteOrder is the ORDER BY prefix of vote-based sorts; it matches
+// model.Sort.Less, with comment_wilson and comment_controversy mirroring
+// model.Wilson and model.Controversy.
+var voteOrder = map[model.Sort]string{
+	model.SortScoreDesc:     "score DESC, ",
+	model.SortControversial: "comment_controversy(upvotes, downvotes) DESC, ",
+	model.SortBest:          "comment_wilson(upvotes, downvotes) DESC, ",
+}
+
+// moveLockKey serializes moves through a transaction-level advisory lock so two
+// concurrent moves cannot close a cycle between them. Inserts under a parent
+// hold it shared: they copy the parent's path, which a move may be rewriting.
+const moveLockKey = 0x636f6d6d656e74
+
 type nodePtr struct {
 	c        model.Comment
 	children []*nodePtr
@@ -62,56 +89,198 @@ func (r *Repo) Exists(ctx context.Context, id int64) (bool, error) {
 	return err == nil, err
 }
 
-func (r *Repo) Create(ctx context.Context, parentID int64, text string) (model.Comment, error) {
+func (r *Repo) Get(ctx context.Context, id int64) (model.Comment, error) {
 	var c model.Comment
-	err := r.db.QueryRow(ctx, `
-		INSERT INTO comments(parent_id, text)
+	err := scanComment(r.db.QueryRow(ctx, `SELECT `+commentColumns+` FROM comments WHERE id=$1`, id), &c)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	return c, nil
+}
+
+// Create inserts a reply only if its parent row can be key-share locked, so
+// the parent cannot disappear between the check and the insert. A missing
+// parent inserts nothing and is reported as storage.ErrParentNotFound. The
+// shared move lock makes the reply wait for a move of its branch, whose new
+// path it then copies.
+func (r *Repo) Create(ctx context.Context, threadKey string, parentID int64, author model.Author, lang model.Language, text string) (model.Comment, error) {
+	var c model.Comment
+	if parentID == 0 {
+		err := scanComment(r.db.QueryRow(ctx, `
+			INSERT INTO comments(parent_id, thread_key, author_id, author_name, lang, text)
+			VALUES (0, $1, $2, $3, $4::regconfig, $5)
+			RETURNING `+commentColumns, threadKey, author.ID, author.Name, lang, text), &c)
+		if err != nil {
+			return model.Comment{}, err
+		}
+		return c, nil
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1)`, moveLockKey); err != nil {
+		return model.Comment{}, err
+	}
+
+	err = scanComment(tx.QueryRow(ctx, `
+		INSERT INTO comments(parent_id, thread_key, author_id, author_name, lang, text)
+		SELECT id, thread_key, $2, $3, $4::regconfig, $5
+		FROM comments
+		WHERE id=$1
+		FOR KEY SHARE
+		RETURNING `+commentColumns, parentID, author.ID, author.Name, lang, text), &c)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return model.Comment{}, storage.ErrParentNotFound
+	}
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return model.Comment{}, err
+	}
+	return c, nil
+}
+
+func (r *Repo) Update(ctx context.Context, id int64, text string) (model.Comment, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var prev string
+	if err := tx.QueryRow(ctx, `
+		SELECT text FROM comments WHERE id=$1 AND deleted_at IS NULL FOR UPDATE
+	`, id).Scan(&prev); err != nil {
+		return model.Comment{}, err
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO comment_revisions(comment_id, text)
 		VALUES ($1, $2)
-		RETURNING id, parent_id, text, created_at
-	`, parentID, text).Scan(&c.ID, &c.ParentID, &c.Text, &c.CreatedAt)
+	`, id, prev); err != nil {
+		return model.Comment{}, err
+	}
+
+	var c model.Comment
+	err = scanComment(tx.QueryRow(ctx, `
+		UPDATE comments
+		SET text=$2, edited_at=now()
+		WHERE id=$1
+		RETURNING `+commentColumns, id, text), &c)
 	if err != nil {
 		return model.Comment{}, err
 	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return model.Comment{}, err
+	}
 	return c, nil
 }
 
-func (r *Repo) GetTreePage(ctx context.Context, parentID int64, page, limit int, sortMode model.Sort) (model.TreePage, error) {
+func (r *Repo) GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, comment_id, text, created_at
+		FROM comment_revisions
+		WHERE comment_id=$1
+		ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]model.CommentRevision, 0, 8)
+	for rows.Next() {
+		var it model.CommentRevision
+		if err := rows.Scan(&it.ID, &it.CommentID, &it.Text, &it.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *Repo) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sortMode model.Sort, cursor *model.Cursor) (model.TreePage, error) {
 	var total int
-	if err := r.db.QueryRow(ctx, `SELECT count(*) FROM comments WHERE parent_id=$1`, parentID).Scan(&total); err != nil {
+	if err := r.db.QueryRow(ctx, `
+		SELECT count(*) FROM comments WHERE parent_id=$1 AND ($2 = '' OR thread_key=$2)
+	`, parentID, threadKey).Scan(&total); err != nil {
 		return model.TreePage{}, err
 	}
 
-	order := "DESC"
-	if sortMode == model.SortCreatedAtAsc {
-		order = "ASC"
-	}
+	desc := sortMode != model.SortCreatedAtAsc
 	offset := (page - 1) * limit
 
-	rows, err := r.db.Query(ctx, fmt.Sprintf(`
-		SELECT id
-		FROM comments
-		WHERE parent_id=$1
-		ORDER BY created_at %s
-		LIMIT $2 OFFSET $3
-	`, order), parentID, limit, offset)
+	var (
+		query string
+		args  []any
+	)
+	if cursor == nil {
+		_, dir := keyset(desc, false)
+		query = fmt.Sprintf(`
+			SELECT id, path::text, created_at
+			FROM comments
+			WHERE parent_id=$1 AND ($2 = '' OR thread_key=$2)
+			ORDER BY %[1]screated_at %[2]s, id %[2]s
+			LIMIT $3 OFFSET $4
+		`, voteOrder[sortMode], dir)
+		args = []any{parentID, threadKey, limit + 1, offset}
+	} else {
+		op, dir := keyset(desc, cursor.Backward)
+		query = fmt.Sprintf(`
+			SELECT id, path::text, created_at
+			FROM comments
+			WHERE parent_id=$1 AND ($2 = '' OR thread_key=$2)
+				AND (created_at, id) %[1]s ($4, $5)
+			ORDER BY created_at %[2]s, id %[2]s
+			LIMIT $3
+		`, op, dir)
+		args = []any{parentID, threadKey, limit + 1, cursor.CreatedAt, cursor.ID}
+	}
+
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
 		return model.TreePage{}, err
 	}
 	defer rows.Close()
 
-	var roots []int64
+	type rootRow struct {
+		id        int64
+		path      string
+		createdAt time.Time
+	}
+	var found []rootRow
 	for rows.Next() {
-		var id int64
-		if err := rows.Scan(&id); err != nil {
+		var rr rootRow
+		if err := rows.Scan(&rr.id, &rr.path, &rr.createdAt); err != nil {
 			return model.TreePage{}, err
 		}
-		roots = append(roots, id)
+		found = append(found, rr)
 	}
 	if err := rows.Err(); err != nil {
 		return model.TreePage{}, err
 	}
 
-	if len(roots) == 0 {
+	hasMore := len(found) > limit
+	if hasMore {
+		found = found[:limit]
+	}
+	if cursor != nil && cursor.Backward {
+		for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+			found[i], found[j] = found[j], found[i]
+		}
+	}
+
+	if len(found) == 0 {
 		return model.TreePage{
 			Items: []model.CommentNode{},
 			Page:  page,
@@ -120,21 +289,18 @@ func (r *Repo) GetTreePage(ctx context.Context, parentID int64, page, limit int,
 		}, nil
 	}
 
-	treeRows, err := r.db.Query(ctx, `
-		WITH RECURSIVE t AS (
-			SELECT id, parent_id, text, created_at
-			FROM comments
-			WHERE id = ANY($1)
-
-			UNION ALL
+	roots := make([]int64, 0, len(found))
+	paths := make([]string, 0, len(found))
+	for _, rr := range found {
+		roots = append(roots, rr.id)
+		paths = append(paths, rr.path)
+	}
 
-			SELECT c.id, c.parent_id, c.text, c.created_at
-			FROM comments c
-			JOIN t ON c.parent_id = t.id
-		)
-		SELECT id, parent_id, text, created_at
-		FROM t
-	`, roots)
+	treeRows, err := r.db.Query(ctx, `
+		SELECT `+commentColumns+`
+		FROM unnest($1::text[]) AS r(p)
+		JOIN comments ON path <@ r.p::ltree
+	`, paths)
 	if err != nil {
 		return model.TreePage{}, err
 	}
@@ -143,7 +309,7 @@ func (r *Repo) GetTreePage(ctx context.Context, parentID int64, page, limit int,
 	nodes := make(map[int64]*nodePtr, 256)
 	for treeRows.Next() {
 		var c model.Comment
-		if err := treeRows.Scan(&c.ID, &c.ParentID, &c.Text, &c.CreatedAt); err != nil {
+		if err := scanComment(treeRows, &c); err != nil {
 			return model.TreePage{}, err
 		}
 		nodes[c.ID] = &nodePtr{c: c}
@@ -165,48 +331,301 @@ func (r *Repo) GetTreePage(ctx context.Context, parentID int64, page, limit int,
 		}
 	}
 
-	return model.TreePage{
+	tp := model.TreePage{
 		Items: items,
 		Page:  page,
 		Limit: limit,
 		Total: total,
-	}, nil
+	}
+	if sortMode.ByVotes() {
+		return tp, nil
+	}
+	hasPrev, hasNext := pageLinks(cursor, offset, hasMore)
+	if hasPrev {
+		first := found[0]
+		tp.PrevCursor = model.Cursor{Sort: sortMode, CreatedAt: first.createdAt, ID: first.id, Backward: true}.Encode()
+	}
+	if hasNext {
+		last := found[len(found)-1]
+		tp.NextCursor = model.Cursor{Sort: sortMode, CreatedAt: last.createdAt, ID: last.id}.Encode()
+	}
+	return tp, nil
+}
+
+// keyset returns the row comparison and ORDER BY direction that walk a sort
+// from a cursor: after it for next pages, before it for previous ones.
+func keyset(desc, backward bool) (op, dir string) {
+	if desc != backward {
+		return "<", "DESC"
+	}
+	return ">", "ASC"
+}
+
+// pageLinks reports whether a non-empty page fetched with one extra row has
+// neighbours on either side. hasMore is true when the extra row came back.
+func pageLinks(cursor *model.Cursor, offset int, hasMore bool) (hasPrev, hasNext bool) {
+	switch {
+	case cursor == nil:
+		return offset > 0, hasMore
+	case cursor.Backward:
+		return hasMore, true
+	default:
+		return true, hasMore
+	}
 }
 
+// DeleteSubtree locks the subtree before deleting it. A Create that already
+// holds a key-share lock on one of its rows makes the lock wait, and the
+// DELETE, running with a later snapshot, then sees the new reply and removes
+// it too; a Create arriving after the lock finds its parent gone.
 func (r *Repo) DeleteSubtree(ctx context.Context, id int64) (int, error) {
-	rows, err := r.db.Query(ctx, `
-		WITH RECURSIVE t AS (
-			SELECT id FROM comments WHERE id=$1
-			UNION ALL
-			SELECT c.id FROM comments c JOIN t ON c.parent_id = t.id
-		)
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `
+		SELECT 1 FROM comments
+		WHERE path <@ (SELECT path FROM comments WHERE id=$1)
+		FOR UPDATE
+	`, id); err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, `
 		DELETE FROM comments
-		WHERE id IN (SELECT id FROM t)
-		RETURNING id
+		WHERE path <@ (SELECT path FROM comments WHERE id=$1)
 	`, id)
 	if err != nil {
 		return 0, err
 	}
-	defer rows.Close()
 
-	deleted := 0
-	for rows.Next() {
-		deleted++
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
 	}
-	if err := rows.Err(); err != nil {
+	return int(tag.RowsAffected()), nil
+}
+
+func (r *Repo) SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error) {
+	var c model.Comment
+	err := scanComment(r.db.QueryRow(ctx, `
+		UPDATE comments
+		SET deleted_at = coalesce(deleted_at, now()),
+			deleted_by = CASE WHEN deleted_at IS NULL THEN $2 ELSE deleted_by END
+		WHERE id=$1
+		RETURNING `+commentColumns, id, by), &c)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	return c, nil
+}
+
+func (r *Repo) Restore(ctx context.Context, id int64) (model.Comment, error) {
+	var c model.Comment
+	err := scanComment(r.db.QueryRow(ctx, `
+		UPDATE comments
+		SET deleted_at = NULL, deleted_by = ''
+		WHERE id=$1
+		RETURNING `+commentColumns, id), &c)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	return c, nil
+}
+
+func (r *Repo) Move(ctx context.Context, id, newParentID int64) (model.Comment, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, moveLockKey); err != nil {
+		return model.Comment{}, err
+	}
+
+	var one int
+	if err := tx.QueryRow(ctx, `SELECT 1 FROM comments WHERE id=$1 FOR UPDATE`, id).Scan(&one); err != nil {
+		return model.Comment{}, err
+	}
+
+	if newParentID != 0 {
+		var cycle, sameThread bool
+		err := tx.QueryRow(ctx, `
+			SELECT p.path <@ c.path, p.thread_key = c.thread_key
+			FROM comments c, comments p
+			WHERE c.id = $1 AND p.id = $2
+			FOR KEY SHARE OF p
+		`, id, newParentID).Scan(&cycle, &sameThread)
+		if err != nil {
+			return model.Comment{}, err
+		}
+		if cycle {
+			return model.Comment{}, storage.ErrCycle
+		}
+		if !sameThread {
+			return model.Comment{}, storage.ErrThreadMismatch
+		}
+	}
+
+	var c model.Comment
+	err = scanComment(tx.QueryRow(ctx, `
+		UPDATE comments
+		SET parent_id=$2
+		WHERE id=$1
+		RETURNING `+commentColumns, id, newParentID), &c)
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return model.Comment{}, err
+	}
+	return c, nil
+}
+
+// Vote records voter's vote on comment id, replacing an earlier one; value 0
+// takes the vote back. The counters on comments are adjusted in the same
+// transaction, under the comment row lock, so they always match comment_votes.
+func (r *Repo) Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return model.Comment{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var one int
+	if err := tx.QueryRow(ctx, `
+		SELECT 1 FROM comments WHERE id=$1 AND deleted_at IS NULL FOR UPDATE
+	`, id).Scan(&one); err != nil {
+		return model.Comment{}, err
+	}
+
+	prev := 0
+	err = tx.QueryRow(ctx, `
+		SELECT value FROM comment_votes WHERE comment_id=$1 AND voter_id=$2
+	`, id, voter).Scan(&prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return model.Comment{}, err
+	}
+
+	if value == 0 {
+		_, err = tx.Exec(ctx, `DELETE FROM comment_votes WHERE comment_id=$1 AND voter_id=$2`, id, voter)
+	} else {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO comment_votes(comment_id, voter_id, value)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (comment_id, voter_id) DO UPDATE SET value = EXCLUDED.value, created_at = now()
+		`, id, voter, value)
+	}
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	up, down := voteDelta(prev, value)
+	var c model.Comment
+	err = scanComment(tx.QueryRow(ctx, `
+		UPDATE comments
+		SET upvotes = upvotes + $2, downvotes = downvotes + $3
+		WHERE id=$1
+		RETURNING `+commentColumns, id, up, down), &c)
+	if err != nil {
+		return model.Comment{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return model.Comment{}, err
+	}
+	return c, nil
+}
+
+// voteDelta is the change of the up and down counters when a vote goes from
+// prev to next.
+func voteDelta(prev, next int) (up, down int) {
+	for _, v := range []struct{ value, sign int }{{prev, -1}, {next, 1}} {
+		switch v.value {
+		case 1:
+			up += v.sign
+		case -1:
+			down += v.sign
+		}
+	}
+	return up, down
+}
+
+// PurgeDeleted removes tombstones deleted before the cutoff, one leaf level per
+// statement, so a tombstone goes only once nothing but purged tombstones
+// remain below it.
+func (r *Repo) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	for {
+		n, err := r.purgeLeaves(ctx, before)
+		if err != nil {
+			return purged, err
+		}
+		if n == 0 {
+			return purged, nil
+		}
+		purged += n
+	}
+}
+
+// purgeLeaves deletes one layer of childless tombstones. The candidates are
+// locked first and the childless check is repeated by the DELETE, whose newer
+// snapshot sees replies committed while the lock waited.
+func (r *Repo) purgeLeaves(ctx context.Context, before time.Time) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var ids []int64
+	if err := tx.QueryRow(ctx, `
+		SELECT coalesce(array_agg(id), '{}') FROM (
+			SELECT c.id FROM comments c
+			WHERE c.deleted_at < $1
+				AND NOT EXISTS (SELECT 1 FROM comments ch WHERE ch.parent_id = c.id)
+			FOR UPDATE
+		) locked
+	`, before).Scan(&ids); err != nil {
 		return 0, err
 	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
 
-	return deleted, nil
+	tag, err := tx.Exec(ctx, `
+		DELETE FROM comments c
+		WHERE c.id = ANY($1)
+			AND NOT EXISTS (SELECT 1 FROM comments ch WHERE ch.parent_id = c.id)
+	`, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
 }
 
-func (r *Repo) Search(ctx context.Context, q string, page, limit int, sortMode model.Sort) (model.SearchPage, error) {
+// searchQuery is the tsquery of Search: $1 parsed with the configuration $3
+// or as written. The stemmed form finds comments indexed with $3, the plain
+// one exact words in comments of any other language, simple included. Both
+// are constants, so the GIN index on search_tsv still applies.
+const searchQuery = `(plainto_tsquery($3::regconfig, $1) || plainto_tsquery('simple', $1))`
+
+func (r *Repo) Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sortMode model.Sort, cursor *model.Cursor) (model.SearchPage, error) {
 	var total int
 	if err := r.db.QueryRow(ctx, `
 		SELECT count(*)
 		FROM comments
-		WHERE search_tsv @@ plainto_tsquery('simple', $1)
-	`, q).Scan(&total); err != nil {
+		WHERE search_tsv @@ `+searchQuery+`
+			AND deleted_at IS NULL
+			AND ($2 = '' OR thread_key=$2)
+	`, q, threadKey, lang).Scan(&total); err != nil {
 		return model.SearchPage{}, err
 	}
 
@@ -219,41 +638,66 @@ func (r *Repo) Search(ctx context.Context, q string, page, limit int, sortMode m
 		}, nil
 	}
 
-	orderBy := `rank DESC, created_at DESC`
+	key := "rank"
+	desc := true
 	switch sortMode {
-	case "", model.SortRankDesc:
 	case model.SortCreatedAtDesc:
-		orderBy = `created_at DESC, rank DESC`
+		key = "created_at"
 	case model.SortCreatedAtAsc:
-		orderBy = `created_at ASC, rank DESC`
-	default:
-		orderBy = `rank DESC, created_at DESC`
+		key, desc = "created_at", false
 	}
 
 	offset := (page - 1) * limit
+	args := []any{q, threadKey, lang, limit + 1}
+	keysetCond, tail := "", "OFFSET $5"
+	_, dir := keyset(desc, false)
+	if cursor == nil {
+		args = append(args, offset)
+	} else {
+		var op string
+		op, dir = keyset(desc, cursor.Backward)
+		if key == "rank" {
+			keysetCond = fmt.Sprintf(`WHERE (rank, id) %s ($5::float8, $6)`, op)
+			args = append(args, cursor.Rank, cursor.ID)
+		} else {
+			keysetCond = fmt.Sprintf(`WHERE (created_at, id) %s ($5, $6)`, op)
+			args = append(args, cursor.CreatedAt, cursor.ID)
+		}
+		tail = ""
+	}
 
 	rows, err := r.db.Query(ctx, fmt.Sprintf(`
 		SELECT
 			id,
 			parent_id,
-			ts_headline('simple', text, plainto_tsquery('simple', $1),
+			thread_key,
+			author_id,
+			author_name,
+			ts_headline(lang, text, `+searchQuery+`,
 				'StartSel=<mark>, StopSel=</mark>, MaxWords=20, MinWords=10, ShortWord=3, HighlightAll=true') AS snippet,
-			ts_rank(search_tsv, plainto_tsquery('simple', $1)) AS rank,
+			rank,
 			created_at
-		FROM comments
-		WHERE search_tsv @@ plainto_tsquery('simple', $1)
-		ORDER BY %s
-		LIMIT $2 OFFSET $3
-	`, orderBy), q, limit, offset)
+		FROM (
+			SELECT id, parent_id, thread_key, author_id, author_name, text, lang, created_at,
+				ts_rank(search_tsv, `+searchQuery+`)::float8 AS rank
+			FROM comments
+			WHERE search_tsv @@ `+searchQuery+`
+				AND deleted_at IS NULL
+				AND ($2 = '' OR thread_key=$2)
+		) s
+		%[1]s
+		ORDER BY %[2]s %[3]s, id %[3]s
+		LIMIT $4 %[4]s
+	`, keysetCond, key, dir, tail), args...)
 	if err != nil {
 		return model.SearchPage{}, err
 	}
 	defer rows.Close()
 
-	items := make([]model.SearchItem, 0, limit)
+	items := make([]model.SearchItem, 0, limit+1)
 	for rows.Next() {
 		var it model.SearchItem
-		if err := rows.Scan(&it.ID, &it.ParentID, &it.Snippet, &it.Rank, &it.CreatedAt); err != nil {
+		if err := rows.Scan(&it.ID, &it.ParentID, &it.ThreadKey, &it.Author.ID, &it.Author.Name, &it.Snippet, &it.Rank, &it.CreatedAt); err != nil {
 			return model.SearchPage{}, err
 		}
 		items = append(items, it)
@@ -262,28 +706,248 @@ func (r *Repo) Search(ctx context.Context, q string, page, limit int, sortMode m
 		return model.SearchPage{}, err
 	}
 
-	return model.SearchPage{
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	if cursor != nil && cursor.Backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	sp := model.SearchPage{
 		Items: items,
 		Page:  page,
 		Limit: limit,
 		Total: total,
-	}, nil
+	}
+	if len(items) == 0 {
+		return sp, nil
+	}
+	hasPrev, hasNext := pageLinks(cursor, offset, hasMore)
+	if hasPrev {
+		first := items[0]
+		sp.PrevCursor = model.Cursor{Sort: sortMode, CreatedAt: first.CreatedAt, Rank: first.Rank, ID: first.ID, Backward: true}.Encode()
+	}
+	if hasNext {
+		last := items[len(items)-1]
+		sp.NextCursor = model.Cursor{Sort: sortMode, CreatedAt: last.CreatedAt, Rank: last.Rank, ID: last.ID}.Encode()
+	}
+	return sp, nil
 }
 
-func (r *Repo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
+func (r *Repo) Stats(ctx context.Context, top int) (model.Stats, error) {
+	st := model.Stats{TopThreads: []model.ThreadStats{}}
+	if err := r.db.QueryRow(ctx, `
+		SELECT count(*),
+			count(*) FILTER (WHERE deleted_at IS NOT NULL),
+			count(DISTINCT thread_key),
+			coalesce(max(depth), 0)
+		FROM comments
+	`).Scan(&st.Comments, &st.Deleted, &st.Threads, &st.MaxDepth); err != nil {
+		return model.Stats{}, err
+	}
+
 	rows, err := r.db.Query(ctx, `
-		WITH RECURSIVE p AS (
-			SELECT id, parent_id, text
+		SELECT thread_key, count(*) AS n
+		FROM comments
+		GROUP BY thread_key
+		ORDER BY n DESC, thread_key
+		LIMIT $1
+	`, top)
+	if err != nil {
+		return model.Stats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t model.ThreadStats
+		if err := rows.Scan(&t.ThreadKey, &t.Comments); err != nil {
+			return model.Stats{}, err
+		}
+		st.TopThreads = append(st.TopThreads, t)
+	}
+	return st, rows.Err()
+}
+
+func (r *Repo) Export(ctx context.Context, threadKey string, rootID int64, fn func(model.Comment) error) error {
+	var rows pgx.Rows
+	var err error
+	if rootID > 0 {
+		rows, err = r.db.Query(ctx, `
+			SELECT `+commentColumns+`
 			FROM comments
-			WHERE id = $1
+			WHERE path <@ (SELECT path FROM comments WHERE id=$1)
+			ORDER BY depth, created_at, id
+		`, rootID)
+	} else {
+		rows, err = r.db.Query(ctx, `
+			SELECT `+commentColumns+`
+			FROM comments
+			WHERE thread_key=$1
+			ORDER BY depth, created_at, id
+		`, threadKey)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c model.Comment
+		if err := scanComment(rows, &c); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *Repo) Import(ctx context.Context, parentID int64, comments iter.Seq2[model.Comment, error]) (model.ImportResult, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return model.ImportResult{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if parentID != 0 {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1)`, moveLockKey); err != nil {
+			return model.ImportResult{}, err
+		}
+		var one int
+		err := tx.QueryRow(ctx, `SELECT 1 FROM comments WHERE id=$1 FOR KEY SHARE`, parentID).Scan(&one)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return model.ImportResult{}, storage.ErrParentNotFound
+		}
+		if err != nil {
+			return model.ImportResult{}, err
+		}
+	}
+
+	res := model.ImportResult{Roots: []int64{}}
+	ids := make(map[int64]int64)
+	for c, err := range comments {
+		if err != nil {
+			return model.ImportResult{}, err
+		}
+
+		parent, ok := ids[c.ParentID]
+		if !ok {
+			parent = parentID
+		}
+		var createdAt *time.Time
+		if !c.CreatedAt.IsZero() {
+			createdAt = &c.CreatedAt
+		}
+
+		var id int64
+		var threadKey string
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO comments(parent_id, thread_key, author_id, author_name, text, lang, created_at, edited_at, deleted_at, deleted_by)
+			VALUES (
+				$1,
+				coalesce((SELECT thread_key FROM comments WHERE id=$1), $2),
+				$3, $4, $5, $6::regconfig, coalesce($7, now()), $8, $9, $10
+			)
+			RETURNING id, thread_key
+		`, parent, c.ThreadKey, c.Author.ID, c.Author.Name, c.Text, c.Lang, createdAt, c.EditedAt, c.DeletedAt, c.DeletedBy).Scan(&id, &threadKey); err != nil {
+			return model.ImportResult{}, err
+		}
+
+		ids[c.ID] = id
+		if !ok {
+			res.Roots = append(res.Roots, id)
+			res.ThreadKey = threadKey
+		}
+		res.Imported++
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return model.ImportResult{}, err
+	}
+	return res, nil
+}
+
+func (r *Repo) ScanTree(ctx context.Context, fn func(model.TreeLink) error) error {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, parent_id, thread_key, path::text, depth
+		FROM comments
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l model.TreeLink
+		if err := rows.Scan(&l.ID, &l.ParentID, &l.ThreadKey, &l.Path, &l.Depth); err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *Repo) Repair(ctx context.Context, reparent map[int64]int64) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// moves rely on consistent paths; keep them out until the paths are rebuilt
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, moveLockKey); err != nil {
+		return 0, err
+	}
+
+	for id, parentID := range reparent {
+		if _, err := tx.Exec(ctx, `UPDATE comments SET parent_id=$2 WHERE id=$1`, id, parentID); err != nil {
+			return 0, err
+		}
+	}
+
+	// walking down from top-level comments cannot loop: a comment on a cycle
+	// is never reached from one
+	tag, err := tx.Exec(ctx, `
+		WITH RECURSIVE t AS (
+			SELECT id, thread_key, id::text::ltree AS path
+			FROM comments
+			WHERE parent_id = 0
+
 			UNION ALL
-			SELECT c.id, c.parent_id, c.text
+
+			SELECT c.id, t.thread_key, t.path || c.id::text
 			FROM comments c
-			JOIN p ON c.id = p.parent_id
-			WHERE p.parent_id <> 0
+			JOIN t ON c.parent_id = t.id
 		)
-		SELECT id, parent_id, text
-		FROM p
+		UPDATE comments c
+		SET path = t.path, depth = nlevel(t.path) - 1, thread_key = t.thread_key
+		FROM t
+		WHERE c.id = t.id
+			AND (c.path <> t.path OR c.depth <> nlevel(t.path) - 1 OR c.thread_key <> t.thread_key)
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (r *Repo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, parent_id, text, deleted_at IS NOT NULL
+		FROM comments
+		WHERE path @> (SELECT path FROM comments WHERE id=$1)
+		ORDER BY depth
 	`, id)
 	if err != nil {
 		return nil, err
@@ -293,7 +957,7 @@ func (r *Repo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem,
 	var items []model.CommentPathItem
 	for rows.Next() {
 		var it model.CommentPathItem
-		if err := rows.Scan(&it.ID, &it.ParentID, &it.Text); err != nil {
+		if err := rows.Scan(&it.ID, &it.ParentID, &it.Text, &it.Deleted); err != nil {
 			return nil, err
 		}
 		items = append(items, it)
@@ -305,28 +969,14 @@ func (r *Repo) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem,
 		return nil, pgx.ErrNoRows
 	}
 
-	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
-		items[i], items[j] = items[j], items[i]
-	}
-
 	return items, nil
 }
 
 func (r *Repo) GetSubtree(ctx context.Context, id int64, sortMode model.Sort) (model.CommentNode, error) {
 	rows, err := r.db.Query(ctx, `
-		WITH RECURSIVE t AS (
-			SELECT id, parent_id, text, created_at
-			FROM comments
-			WHERE id = $1
-
-			UNION ALL
-
-			SELECT c.id, c.parent_id, c.text, c.created_at
-			FROM comments c
-			JOIN t ON c.parent_id = t.id
-		)
-		SELECT id, parent_id, text, created_at
-		FROM t
+		SELECT `+commentColumns+`
+		FROM comments
+		WHERE path <@ (SELECT path FROM comments WHERE id=$1)
 	`, id)
 	if err != nil {
 		return model.CommentNode{}, err
@@ -336,7 +986,7 @@ func (r *Repo) GetSubtree(ctx context.Context, id int64, sortMode model.Sort) (m
 	nodes := make(map[int64]*nodePtr, 256)
 	for rows.Next() {
 		var c model.Comment
-		if err := rows.Scan(&c.ID, &c.ParentID, &c.Text, &c.CreatedAt); err != nil {
+		if err := scanComment(rows, &c); err != nil {
 			return model.CommentNode{}, err
 		}
 		nodes[c.ID] = &nodePtr{c: c}
@@ -367,12 +1017,7 @@ func toValueTree(n *nodePtr, sortMode model.Sort) model.CommentNode {
 	out := model.CommentNode{Comment: n.c}
 
 	sort.Slice(n.children, func(i, j int) bool {
-		a := n.children[i].c.CreatedAt
-		b := n.children[j].c.CreatedAt
-		if sortMode == model.SortCreatedAtAsc {
-			return a.Before(b)
-		}
-		return a.After(b)
+		return sortMode.Less(n.children[i].c, n.children[j].c)
 	})
 
 	out.Children = make([]model.CommentNode, 0, len(n.children))
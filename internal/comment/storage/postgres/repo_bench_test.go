@@ -0,0 +1,140 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+)
+
+// Benchmarks compare the materialized path queries with the recursive CTEs
+// they replaced. They need a migrated database:
+//
+//	POSTGRES_TEST_DSN=postgres://... go test -run '^$' -bench . ./internal/comment/storage/postgres
+
+const (
+	benchDepth  = 200
+	benchFanout = 3
+)
+
+const cteSubtree = `
+	WITH RECURSIVE t AS (
+		SELECT id FROM comments WHERE id = $1
+		UNION ALL
+		SELECT c.id FROM comments c JOIN t ON c.parent_id = t.id
+	)
+	SELECT ` + commentColumns + `
+	FROM comments
+	WHERE id IN (SELECT id FROM t)`
+
+const pathSubtree = `
+	SELECT ` + commentColumns + `
+	FROM comments
+	WHERE path <@ (SELECT path FROM comments WHERE id = $1)`
+
+const cteAncestors = `
+	WITH RECURSIVE p AS (
+		SELECT id, parent_id FROM comments WHERE id = $1
+		UNION ALL
+		SELECT c.id, c.parent_id FROM comments c JOIN p ON c.id = p.parent_id
+		WHERE p.parent_id <> 0
+	)
+	SELECT id FROM p`
+
+const pathAncestors = `
+	SELECT id
+	FROM comments
+	WHERE path @> (SELECT path FROM comments WHERE id = $1)
+	ORDER BY depth`
+
+// seedThread builds a chain benchDepth deep where every node also gets
+// benchFanout-1 leaf replies, and returns the root and the deepest node.
+func seedThread(b *testing.B) (*Repo, int64, int64) {
+	b.Helper()
+
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		b.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	ctx := context.Background()
+	r, err := NewFromDSN(ctx, dsn)
+	if err != nil {
+		b.Fatalf("connect: %v", err)
+	}
+
+	root, err := r.Create(ctx, "bench", 0, model.Author{}, model.LanguageSimple, "bench root")
+	if err != nil {
+		b.Fatalf("create root: %v", err)
+	}
+
+	leaf := root.ID
+	for d := 0; d < benchDepth; d++ {
+		for i := 1; i < benchFanout; i++ {
+			if _, err := r.Create(ctx, "", leaf, model.Author{}, model.LanguageSimple, "bench sibling"); err != nil {
+				b.Fatalf("create sibling: %v", err)
+			}
+		}
+		c, err := r.Create(ctx, "", leaf, model.Author{}, model.LanguageSimple, "bench chain")
+		if err != nil {
+			b.Fatalf("create chain: %v", err)
+		}
+		leaf = c.ID
+	}
+
+	b.Cleanup(func() {
+		_, _ = r.DeleteSubtree(context.Background(), root.ID)
+		r.Close()
+	})
+	return r, root.ID, leaf
+}
+
+func benchQuery(b *testing.B, r *Repo, query string, id int64, wantRows int) {
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rows, err := r.db.Query(ctx, query, id)
+		if err != nil {
+			b.Fatalf("query: %v", err)
+		}
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			b.Fatalf("rows: %v", err)
+		}
+		if n != wantRows {
+			b.Fatalf("expected %d rows, got %d", wantRows, n)
+		}
+	}
+}
+
+func BenchmarkSubtree(b *testing.B) {
+	r, root, _ := seedThread(b)
+	total := 1 + benchDepth*benchFanout
+
+	b.Run("cte", func(b *testing.B) { benchQuery(b, r, cteSubtree, root, total) })
+	b.Run("path", func(b *testing.B) { benchQuery(b, r, pathSubtree, root, total) })
+}
+
+func BenchmarkAncestors(b *testing.B) {
+	r, _, leaf := seedThread(b)
+
+	b.Run("cte", func(b *testing.B) { benchQuery(b, r, cteAncestors, leaf, benchDepth+1) })
+	b.Run("path", func(b *testing.B) { benchQuery(b, r, pathAncestors, leaf, benchDepth+1) })
+}
+
+func BenchmarkGetSubtree(b *testing.B) {
+	r, root, _ := seedThread(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.GetSubtree(ctx, root, model.SortCreatedAtDesc); err != nil {
+			b.Fatalf("GetSubtree: %v", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+)
+
+// These tests need a migrated database:
+//
+//	POSTGRES_TEST_DSN=postgres://... go test ./internal/comment/storage/postgres
+
+func testRepo(t *testing.T) *Repo {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+	r, err := NewFromDSN(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestCreateWaitsForMove(t *testing.T) {
+	r := testRepo(t)
+	ctx := context.Background()
+
+	create := func(threadKey string, parentID int64) model.Comment {
+		t.Helper()
+		c, err := r.Create(ctx, threadKey, parentID, model.Author{}, model.LanguageSimple, "race")
+		if err != nil {
+			t.Fatalf("create under %d: %v", parentID, err)
+		}
+		return c
+	}
+	from := create("move-race", 0)
+	to := create("move-race", 0)
+	t.Cleanup(func() {
+		_, _ = r.DeleteSubtree(context.Background(), from.ID)
+		_, _ = r.DeleteSubtree(context.Background(), to.ID)
+	})
+	branch := create("", from.ID)
+	parent := create("", branch.ID)
+
+	// hold a move of the branch open the way Move does, with the paths below
+	// it already rewritten but not committed
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, moveLockKey); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if _, err := tx.Exec(ctx, `UPDATE comments SET parent_id=$2 WHERE id=$1`, branch.ID, to.ID); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+
+	type result struct {
+		c   model.Comment
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := r.Create(ctx, "", parent.ID, model.Author{}, model.LanguageSimple, "reply")
+		done <- result{c, err}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("reply was inserted while its branch was being moved")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("create reply: %v", res.err)
+	}
+	var path string
+	if err := r.db.QueryRow(ctx, `SELECT path::text FROM comments WHERE id=$1`, res.c.ID).Scan(&path); err != nil {
+		t.Fatalf("read path: %v", err)
+	}
+	if want := fmt.Sprintf("%d.%d.%d.%d", to.ID, branch.ID, parent.ID, res.c.ID); path != want {
+		t.Fatalf("reply path %s, want %s", path, want)
+	}
+}
@@ -2,16 +2,49 @@ package storage
 
 import (
 	"context"
+	"iter"
+	"time"
 
 	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
 )
 
 type Repository interface {
-	Create(ctx context.Context, parentID int64, text string) (model.Comment, error)
-	GetTreePage(ctx context.Context, parentID int64, page, limit int, sort model.Sort) (model.TreePage, error)
+	// Create stores a comment whose text is indexed for search with lang.
+	Create(ctx context.Context, threadKey string, parentID int64, author model.Author, lang model.Language, text string) (model.Comment, error)
+	Update(ctx context.Context, id int64, text string) (model.Comment, error)
+	GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error)
+	GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sort model.Sort, cursor *model.Cursor) (model.TreePage, error)
 	DeleteSubtree(ctx context.Context, id int64) (int, error)
-	Search(ctx context.Context, q string, page, limit int, sort model.Sort) (model.SearchPage, error)
+	SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error)
+	Restore(ctx context.Context, id int64) (model.Comment, error)
+	Move(ctx context.Context, id, newParentID int64) (model.Comment, error)
+	Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	// Search matches q parsed with lang, and q as written, against comments
+	// of every language.
+	Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sort model.Sort, cursor *model.Cursor) (model.SearchPage, error)
 	Exists(ctx context.Context, id int64) (bool, error)
+	Get(ctx context.Context, id int64) (model.Comment, error)
 	GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error)
 	GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error)
+	// Stats counts comments and lists the top threads by size.
+	Stats(ctx context.Context, top int) (model.Stats, error)
+	// Export calls fn for every comment of threadKey, or of the subtree of
+	// rootID when it is set, ordered by depth, created_at and id, so parents
+	// come before their replies.
+	Export(ctx context.Context, threadKey string, rootID int64, fn func(model.Comment) error) error
+	// Import inserts comments in one transaction under new ids, keeping their
+	// authors, created_at and edit and deletion marks. Comments arrive parents
+	// first; one whose ParentID is not an imported comment goes under parentID,
+	// into its own ThreadKey when parentID is 0. An error from comments rolls
+	// the import back.
+	Import(ctx context.Context, parentID int64, comments iter.Seq2[model.Comment, error]) (model.ImportResult, error)
+	// ScanTree calls fn with the stored links of every comment. It relies on
+	// none of them being consistent, so it is safe on a broken tree.
+	ScanTree(ctx context.Context, fn func(model.TreeLink) error) error
+	// Repair points each key of reparent at its value as parent, without the
+	// checks Move does, then recomputes the thread, path and depth of every
+	// comment reachable from a top-level one. It returns how many comments the
+	// recomputation changed.
+	Repair(ctx context.Context, reparent map[int64]int64) (int, error)
 }
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/MyNameIsWhaaat/commenttree/internal/comment/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traced opens a span around every call of the wrapped repository.
+type traced struct {
+	next   Repository
+	tracer trace.Tracer
+}
+
+// Trace wraps repo so that each method runs in a "repo.<Method>" span carrying
+// its arguments and the number of rows it returned.
+func Trace(repo Repository, tp trace.TracerProvider) Repository {
+	return &traced{next: repo, tracer: tp.Tracer("github.com/MyNameIsWhaaat/commenttree/internal/comment/storage")}
+}
+
+func (r *traced) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return r.tracer.Start(ctx, "repo."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// finish records the outcome; rows < 0 means the method returns no rows.
+func finish(span trace.Span, rows int, err error) {
+	if rows >= 0 {
+		span.SetAttributes(attribute.Int("rows", rows))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func rowsIf(err error, n int) int {
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func countNodes(n model.CommentNode) int {
+	total := 1
+	for _, c := range n.Children {
+		total += countNodes(c)
+	}
+	return total
+}
+
+func (r *traced) Create(ctx context.Context, threadKey string, parentID int64, author model.Author, lang model.Language, text string) (model.Comment, error) {
+	ctx, span := r.start(ctx, "Create", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.parent_id", parentID), attribute.String("lang", string(lang)))
+	v, err := r.next.Create(ctx, threadKey, parentID, author, lang, text)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) Update(ctx context.Context, id int64, text string) (model.Comment, error) {
+	ctx, span := r.start(ctx, "Update", attribute.Int64("comment.id", id))
+	v, err := r.next.Update(ctx, id, text)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) GetRevisions(ctx context.Context, id int64) ([]model.CommentRevision, error) {
+	ctx, span := r.start(ctx, "GetRevisions", attribute.Int64("comment.id", id))
+	v, err := r.next.GetRevisions(ctx, id)
+	finish(span, len(v), err)
+	return v, err
+}
+
+func (r *traced) GetTreePage(ctx context.Context, threadKey string, parentID int64, page, limit int, sort model.Sort, cursor *model.Cursor) (model.TreePage, error) {
+	ctx, span := r.start(ctx, "GetTreePage", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.parent_id", parentID), attribute.Int("page", page), attribute.Int("limit", limit), attribute.String("sort", string(sort)), attribute.Bool("cursor", cursor != nil))
+	v, err := r.next.GetTreePage(ctx, threadKey, parentID, page, limit, sort, cursor)
+	finish(span, len(v.Items), err)
+	return v, err
+}
+
+func (r *traced) DeleteSubtree(ctx context.Context, id int64) (int, error) {
+	ctx, span := r.start(ctx, "DeleteSubtree", attribute.Int64("comment.id", id))
+	v, err := r.next.DeleteSubtree(ctx, id)
+	finish(span, v, err)
+	return v, err
+}
+
+func (r *traced) SoftDelete(ctx context.Context, id int64, by string) (model.Comment, error) {
+	ctx, span := r.start(ctx, "SoftDelete", attribute.Int64("comment.id", id))
+	v, err := r.next.SoftDelete(ctx, id, by)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) Restore(ctx context.Context, id int64) (model.Comment, error) {
+	ctx, span := r.start(ctx, "Restore", attribute.Int64("comment.id", id))
+	v, err := r.next.Restore(ctx, id)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) Move(ctx context.Context, id, newParentID int64) (model.Comment, error) {
+	ctx, span := r.start(ctx, "Move", attribute.Int64("comment.id", id), attribute.Int64("comment.parent_id", newParentID))
+	v, err := r.next.Move(ctx, id, newParentID)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) Vote(ctx context.Context, id int64, voter string, value int) (model.Comment, error) {
+	ctx, span := r.start(ctx, "Vote", attribute.Int64("comment.id", id), attribute.Int("vote.value", value))
+	v, err := r.next.Vote(ctx, id, voter, value)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := r.start(ctx, "PurgeDeleted", attribute.String("before", before.Format(time.RFC3339)))
+	v, err := r.next.PurgeDeleted(ctx, before)
+	finish(span, v, err)
+	return v, err
+}
+
+func (r *traced) Search(ctx context.Context, threadKey, q string, lang model.Language, page, limit int, sort model.Sort, cursor *model.Cursor) (model.SearchPage, error) {
+	ctx, span := r.start(ctx, "Search", attribute.String("comment.thread_key", threadKey), attribute.String("lang", string(lang)), attribute.Int("page", page), attribute.Int("limit", limit), attribute.String("sort", string(sort)), attribute.Bool("cursor", cursor != nil))
+	v, err := r.next.Search(ctx, threadKey, q, lang, page, limit, sort, cursor)
+	finish(span, len(v.Items), err)
+	return v, err
+}
+
+func (r *traced) Exists(ctx context.Context, id int64) (bool, error) {
+	ctx, span := r.start(ctx, "Exists", attribute.Int64("comment.id", id))
+	v, err := r.next.Exists(ctx, id)
+	finish(span, -1, err)
+	return v, err
+}
+
+func (r *traced) Get(ctx context.Context, id int64) (model.Comment, error) {
+	ctx, span := r.start(ctx, "Get", attribute.Int64("comment.id", id))
+	v, err := r.next.Get(ctx, id)
+	finish(span, rowsIf(err, 1), err)
+	return v, err
+}
+
+func (r *traced) GetSubtree(ctx context.Context, id int64, sort model.Sort) (model.CommentNode, error) {
+	ctx, span := r.start(ctx, "GetSubtree", attribute.Int64("comment.id", id), attribute.String("sort", string(sort)))
+	v, err := r.next.GetSubtree(ctx, id, sort)
+	finish(span, countNodes(v), err)
+	return v, err
+}
+
+func (r *traced) Stats(ctx context.Context, top int) (model.Stats, error) {
+	ctx, span := r.start(ctx, "Stats", attribute.Int("top", top))
+	v, err := r.next.Stats(ctx, top)
+	finish(span, rowsIf(err, v.Comments), err)
+	return v, err
+}
+
+func (r *traced) Export(ctx context.Context, threadKey string, rootID int64, fn func(model.Comment) error) error {
+	ctx, span := r.start(ctx, "Export", attribute.String("comment.thread_key", threadKey), attribute.Int64("comment.id", rootID))
+	rows := 0
+	err := r.next.Export(ctx, threadKey, rootID, func(c model.Comment) error {
+		rows++
+		return fn(c)
+	})
+	finish(span, rows, err)
+	return err
+}
+
+func (r *traced) Import(ctx context.Context, parentID int64, comments iter.Seq2[model.Comment, error]) (model.ImportResult, error) {
+	ctx, span := r.start(ctx, "Import", attribute.Int64("comment.parent_id", parentID))
+	v, err := r.next.Import(ctx, parentID, comments)
+	finish(span, v.Imported, err)
+	return v, err
+}
+
+func (r *traced) ScanTree(ctx context.Context, fn func(model.TreeLink) error) error {
+	ctx, span := r.start(ctx, "ScanTree")
+	rows := 0
+	err := r.next.ScanTree(ctx, func(l model.TreeLink) error {
+		rows++
+		return fn(l)
+	})
+	finish(span, rows, err)
+	return err
+}
+
+func (r *traced) Repair(ctx context.Context, reparent map[int64]int64) (int, error) {
+	ctx, span := r.start(ctx, "Repair", attribute.Int("reparent", len(reparent)))
+	v, err := r.next.Repair(ctx, reparent)
+	finish(span, rowsIf(err, v), err)
+	return v, err
+}
+
+func (r *traced) GetPath(ctx context.Context, id int64) ([]model.CommentPathItem, error) {
+	ctx, span := r.start(ctx, "GetPath", attribute.Int64("comment.id", id))
+	v, err := r.next.GetPath(ctx, id)
+	finish(span, len(v), err)
+	return v, err
+}
@@ -0,0 +1,5 @@
+-- 0002_comment_revisions.down.sql
+
+DROP TABLE IF EXISTS comment_revisions;
+
+ALTER TABLE comments DROP COLUMN IF EXISTS edited_at;
\ No newline at end of file
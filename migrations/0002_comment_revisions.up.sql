@@ -0,0 +1,12 @@
+-- 0002_comment_revisions.up.sql
+
+ALTER TABLE comments ADD COLUMN edited_at TIMESTAMPTZ;
+
+CREATE TABLE comment_revisions (
+  id         BIGSERIAL PRIMARY KEY,
+  comment_id BIGINT NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+  text       TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_comment_revisions_comment_id ON comment_revisions(comment_id);
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- 0003_soft_delete.down.sql
+
+DROP INDEX IF EXISTS idx_comments_deleted_at;
+
+ALTER TABLE comments
+  DROP COLUMN IF EXISTS deleted_by,
+  DROP COLUMN IF EXISTS deleted_at;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- 0003_soft_delete.up.sql
+
+ALTER TABLE comments
+  ADD COLUMN deleted_at TIMESTAMPTZ,
+  ADD COLUMN deleted_by TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_comments_deleted_at ON comments(deleted_at) WHERE deleted_at IS NOT NULL;
\ No newline at end of file
@@ -0,0 +1,12 @@
+-- 0004_materialized_path.down.sql
+
+DROP TRIGGER IF EXISTS comments_move_descendants ON comments;
+DROP TRIGGER IF EXISTS comments_set_path_update ON comments;
+DROP TRIGGER IF EXISTS comments_set_path_insert ON comments;
+
+DROP FUNCTION IF EXISTS comments_move_descendants();
+DROP FUNCTION IF EXISTS comments_set_path();
+
+ALTER TABLE comments
+  DROP COLUMN IF EXISTS depth,
+  DROP COLUMN IF EXISTS path;
\ No newline at end of file
@@ -0,0 +1,52 @@
+-- 0004_materialized_path.up.sql
+
+CREATE EXTENSION IF NOT EXISTS ltree;
+
+ALTER TABLE comments
+  ADD COLUMN path  ltree,
+  ADD COLUMN depth INT;
+
+-- comments_set_path fills path/depth of a new or re-parented row from its parent.
+CREATE FUNCTION comments_set_path() RETURNS trigger AS $$
+DECLARE
+  parent_path ltree;
+BEGIN
+  IF NEW.parent_id = 0 THEN
+    NEW.path := NEW.id::text::ltree;
+  ELSE
+    SELECT path INTO parent_path FROM comments WHERE id = NEW.parent_id;
+    IF parent_path IS NULL THEN
+      RAISE EXCEPTION 'parent comment % not found', NEW.parent_id
+        USING ERRCODE = 'foreign_key_violation';
+    END IF;
+    NEW.path := parent_path || NEW.id::text;
+  END IF;
+  NEW.depth := nlevel(NEW.path) - 1;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- comments_move_descendants rewrites the paths below a re-parented row.
+CREATE FUNCTION comments_move_descendants() RETURNS trigger AS $$
+BEGIN
+  UPDATE comments
+  SET path  = NEW.path || subpath(path, nlevel(OLD.path)),
+      depth = nlevel(NEW.path || subpath(path, nlevel(OLD.path))) - 1
+  WHERE path <@ OLD.path AND id <> NEW.id;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER comments_set_path_insert
+  BEFORE INSERT ON comments
+  FOR EACH ROW EXECUTE FUNCTION comments_set_path();
+
+CREATE TRIGGER comments_set_path_update
+  BEFORE UPDATE OF parent_id ON comments
+  FOR EACH ROW WHEN (OLD.parent_id IS DISTINCT FROM NEW.parent_id)
+  EXECUTE FUNCTION comments_set_path();
+
+CREATE TRIGGER comments_move_descendants
+  AFTER UPDATE OF parent_id ON comments
+  FOR EACH ROW WHEN (OLD.parent_id IS DISTINCT FROM NEW.parent_id)
+  EXECUTE FUNCTION comments_move_descendants();
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- 0005_backfill_path.down.sql
+
+DROP INDEX IF EXISTS idx_comments_path;
+
+ALTER TABLE comments
+  ALTER COLUMN path DROP NOT NULL,
+  ALTER COLUMN depth DROP NOT NULL;
\ No newline at end of file
@@ -0,0 +1,58 @@
+-- 0005_backfill_path.up.sql
+
+-- Rows whose parent is missing are rooted at themselves so the column can be
+-- made NOT NULL.
+
+WITH RECURSIVE t AS (
+  SELECT id, id::text::ltree AS path
+  FROM comments
+  WHERE parent_id = 0
+    OR NOT EXISTS (SELECT 1 FROM comments p WHERE p.id = comments.parent_id)
+
+  UNION ALL
+
+  SELECT c.id, t.path || c.id::text
+  FROM comments c
+  JOIN t ON c.parent_id = t.id
+)
+UPDATE comments c
+SET path = t.path, depth = nlevel(t.path) - 1
+FROM t
+WHERE c.id = t.id AND c.path IS NULL;
+
+-- Without a foreign key parent links may also form cycles, which no root
+-- reaches. Each round roots the lowest id still without a path at itself, the
+-- way orphans are, and fills the rows below it; the walk stops when it comes
+-- back around the cycle.
+DO $$
+DECLARE
+  loose_id BIGINT;
+BEGIN
+  LOOP
+    SELECT min(id) INTO loose_id FROM comments WHERE path IS NULL;
+    EXIT WHEN loose_id IS NULL;
+    RAISE NOTICE 'comment % is on or below a parent cycle, rooting it at itself', loose_id;
+
+    WITH RECURSIVE t AS (
+      SELECT loose_id AS id, loose_id::text::ltree AS path
+
+      UNION ALL
+
+      SELECT c.id, t.path || c.id::text
+      FROM comments c
+      JOIN t ON c.parent_id = t.id
+      WHERE c.id <> loose_id
+    )
+    UPDATE comments c
+    SET path = t.path, depth = nlevel(t.path) - 1
+    FROM t
+    WHERE c.id = t.id AND c.path IS NULL;
+  END LOOP;
+END
+$$;
+
+ALTER TABLE comments
+  ALTER COLUMN path SET NOT NULL,
+  ALTER COLUMN depth SET NOT NULL;
+
+CREATE INDEX idx_comments_path ON comments USING GIST (path);
\ No newline at end of file
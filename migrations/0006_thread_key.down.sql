@@ -0,0 +1,5 @@
+-- 0006_thread_key.down.sql
+
+DROP INDEX IF EXISTS idx_comments_thread_roots;
+
+ALTER TABLE comments DROP COLUMN IF EXISTS thread_key;
\ No newline at end of file
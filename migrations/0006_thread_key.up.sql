@@ -0,0 +1,7 @@
+-- 0006_thread_key.up.sql
+
+-- Existing comments form the single legacy thread "default".
+ALTER TABLE comments ADD COLUMN thread_key TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE comments ALTER COLUMN thread_key DROP DEFAULT;
+
+CREATE INDEX idx_comments_thread_roots ON comments(thread_key, created_at, id) WHERE parent_id = 0;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- 0007_authors.down.sql
+
+DROP INDEX IF EXISTS idx_comments_author_id;
+
+ALTER TABLE comments
+  DROP COLUMN IF EXISTS author_name,
+  DROP COLUMN IF EXISTS author_id;
\ No newline at end of file
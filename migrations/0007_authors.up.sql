@@ -0,0 +1,7 @@
+-- 0007_authors.up.sql
+
+ALTER TABLE comments
+  ADD COLUMN author_id   TEXT NOT NULL DEFAULT '',
+  ADD COLUMN author_name TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_comments_author_id ON comments(author_id) WHERE author_id <> '';
\ No newline at end of file
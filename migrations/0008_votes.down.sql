@@ -0,0 +1,11 @@
+-- 0008_votes.down.sql
+
+DROP INDEX IF EXISTS idx_comments_parent_score;
+DROP FUNCTION IF EXISTS comment_controversy(INT, INT);
+DROP FUNCTION IF EXISTS comment_wilson(INT, INT);
+DROP TABLE IF EXISTS comment_votes;
+
+ALTER TABLE comments
+  DROP COLUMN IF EXISTS score,
+  DROP COLUMN IF EXISTS downvotes,
+  DROP COLUMN IF EXISTS upvotes;
\ No newline at end of file
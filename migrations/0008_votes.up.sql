@@ -0,0 +1,33 @@
+-- 0008_votes.up.sql
+
+ALTER TABLE comments
+  ADD COLUMN upvotes   INT NOT NULL DEFAULT 0,
+  ADD COLUMN downvotes INT NOT NULL DEFAULT 0,
+  ADD COLUMN score     INT GENERATED ALWAYS AS (upvotes - downvotes) STORED;
+
+CREATE TABLE comment_votes (
+  comment_id BIGINT NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+  voter_id   TEXT NOT NULL,
+  value      SMALLINT NOT NULL CHECK (value IN (-1, 1)),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (comment_id, voter_id)
+);
+
+-- Same formulas as model.Wilson and model.Controversy.
+CREATE FUNCTION comment_wilson(up INT, down INT) RETURNS DOUBLE PRECISION
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+  SELECT CASE WHEN up + down = 0 THEN 0 ELSE
+    (up::float8 / (up + down) + 1.9208 / (up + down)
+      - 1.96 * sqrt(up::float8 * down / (up + down) + 0.9604) / (up + down))
+    / (1 + 3.8416 / (up + down))
+  END
+$$;
+
+CREATE FUNCTION comment_controversy(up INT, down INT) RETURNS DOUBLE PRECISION
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+  SELECT CASE WHEN up <= 0 OR down <= 0 THEN 0 ELSE
+    power((up + down)::float8, least(up, down)::float8 / greatest(up, down))
+  END
+$$;
+
+CREATE INDEX idx_comments_parent_score ON comments(parent_id, score DESC, created_at DESC, id DESC);
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- 0009_search_lang.down.sql
+
+DROP INDEX IF EXISTS idx_comments_search_tsv;
+ALTER TABLE comments DROP COLUMN IF EXISTS search_tsv;
+ALTER TABLE comments
+  ADD COLUMN search_tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', coalesce(text, ''))) STORED;
+
+CREATE INDEX idx_comments_search_tsv ON comments USING GIN (search_tsv);
+
+ALTER TABLE comments DROP COLUMN IF EXISTS lang;
\ No newline at end of file
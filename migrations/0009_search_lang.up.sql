@@ -0,0 +1,14 @@
+-- 0009_search_lang.up.sql
+
+-- Each comment is indexed with its own text search configuration. Existing
+-- comments keep simple, the configuration their vectors were built with.
+ALTER TABLE comments ADD COLUMN lang regconfig NOT NULL DEFAULT 'simple';
+
+-- A generated column cannot change its expression, so the vector is dropped
+-- and added again, which recomputes it for every row.
+DROP INDEX IF EXISTS idx_comments_search_tsv;
+ALTER TABLE comments DROP COLUMN search_tsv;
+ALTER TABLE comments
+  ADD COLUMN search_tsv tsvector GENERATED ALWAYS AS (to_tsvector(lang, coalesce(text, ''))) STORED;
+
+CREATE INDEX idx_comments_search_tsv ON comments USING GIN (search_tsv);
\ No newline at end of file
@@ -1,14 +1,24 @@
+// ветка обсуждения берётся из ?thread=..., по умолчанию общая "default"
+const threadKey = new URLSearchParams(location.search).get("thread") || "default";
+
+// JWT для изменяющих запросов: localStorage.setItem("token", "...")
+function authHeaders(extra = {}) {
+  const token = localStorage.getItem("token");
+  return token ? { ...extra, Authorization: `Bearer ${token}` } : extra;
+}
+
 const api = {
   async create(parent_id, text) {
     return fetch("/comments", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ parent_id, text })
+      headers: authHeaders({ "Content-Type": "application/json" }),
+      body: JSON.stringify({ thread_key: threadKey, parent_id, text })
     });
   },
 
   async getTree(parent, page, limit, sort) {
     const u = new URL("/comments", location.origin);
+    u.searchParams.set("thread", threadKey);
     u.searchParams.set("parent", String(parent));
     u.searchParams.set("page", String(page));
     u.searchParams.set("limit", String(limit));
@@ -16,12 +26,21 @@ const api = {
     return fetch(u.toString());
   },
 
+  async vote(id, value) {
+    return fetch(`/comments/${id}/vote`, {
+      method: "POST",
+      headers: authHeaders({ "Content-Type": "application/json" }),
+      body: JSON.stringify({ value })
+    });
+  },
+
   async del(id) {
-    return fetch(`/comments/${id}`, { method: "DELETE" });
+    return fetch(`/comments/${id}`, { method: "DELETE", headers: authHeaders() });
   },
 
   async search(q, page, limit, sort) {
     const u = new URL("/comments/search", location.origin);
+    u.searchParams.set("thread", threadKey);
     u.searchParams.set("q", q);
     u.searchParams.set("page", String(page));
     u.searchParams.set("limit", String(limit));
@@ -86,6 +105,11 @@ function escapeHtml(s) {
     .replaceAll("'", "&#039;");
 }
 
+function authorLabel(author) {
+  if (!author) return "аноним";
+  return escapeHtml(author.name || author.id);
+}
+
 function renderTree(nodes) {
   els.tree.innerHTML = "";
   if (!nodes || nodes.length === 0) {
@@ -109,10 +133,13 @@ function renderNode(node) {
     <div class="${isHighlighted ? "highlight" : ""}">
       <div class="nodeHead">
         <div class="nodeText">
-          <div>${escapeHtml(node.text)}</div>
-          <div class="nodeMeta">id=${node.id} · parent=${node.parent_id} · ${fmtDate(node.created_at)}</div>
+          <div class="nodeBody">${escapeHtml(node.text)}</div>
+          <div class="nodeMeta">${authorLabel(node.author)} · id=${node.id} · parent=${node.parent_id} · ${fmtDate(node.created_at)}</div>
         </div>
         <div class="nodeActions">
+          <button class="secondary upBtn" title="+1">▲</button>
+          <span class="score">${node.score ?? 0}</span>
+          <button class="secondary downBtn" title="−1">▼</button>
           <button class="secondary replyToggle">Ответить</button>
           <button class="danger deleteBtn">Удалить</button>
         </div>
@@ -125,6 +152,18 @@ function renderNode(node) {
     </div>
   `;
 
+  const onVote = (value) => async () => {
+    const resp = await api.vote(node.id, value);
+    if (!resp.ok) {
+      const e = await safeJson(resp);
+      return setStatus(`Ошибка голосования: ${e?.detail || e?.title || resp.status}`, "err");
+    }
+    const c = await resp.json();
+    wrap.querySelector(".score").textContent = c.score;
+  };
+  wrap.querySelector(".upBtn").addEventListener("click", onVote(1));
+  wrap.querySelector(".downBtn").addEventListener("click", onVote(-1));
+
   wrap.querySelector(".replyToggle").addEventListener("click", () => {
     const row = wrap.querySelector(".replyRow");
     row.style.display = (row.style.display === "none") ? "flex" : "none";
@@ -138,7 +177,7 @@ function renderNode(node) {
     const resp = await api.create(node.id, text);
     if (!resp.ok) {
       const e = await safeJson(resp);
-      return setStatus(`Ошибка создания: ${e?.error || resp.status}`, "err");
+      return setStatus(`Ошибка создания: ${e?.detail || e?.title || resp.status}`, "err");
     }
     input.value = "";
     setStatus("Ответ добавлен", "ok");
@@ -151,7 +190,7 @@ function renderNode(node) {
     const resp = await api.del(node.id);
     if (!resp.ok) {
       const e = await safeJson(resp);
-      return setStatus(`Ошибка удаления: ${e?.error || resp.status}`, "err");
+      return setStatus(`Ошибка удаления: ${e?.detail || e?.title || resp.status}`, "err");
     }
     const data = await resp.json();
     setStatus(`Удалено: ${data.deleted}`, "ok");
@@ -183,14 +222,73 @@ function scrollToHighlight() {
   if (el) el.scrollIntoView({ behavior: "smooth", block: "center" });
 }
 
+// живые обновления: SSE-поток ветки или всего обсуждения
+let stream = null;
+
+function subscribe(rootId) {
+  if (stream) stream.close();
+  const u = new URL("/comments/stream", location.origin);
+  if (rootId) u.searchParams.set("root", String(rootId));
+  else u.searchParams.set("thread", threadKey);
+
+  stream = new EventSource(u.toString());
+  stream.addEventListener("created", (e) => onCreated(JSON.parse(e.data)));
+  stream.addEventListener("edited", (e) => onEdited(JSON.parse(e.data)));
+  stream.addEventListener("deleted", (e) => onDeleted(JSON.parse(e.data)));
+  // пропущенные события уже не восстановить — перечитываем дерево
+  stream.addEventListener("reset", () => reloadCurrentTree());
+}
+
+function nodeEl(id) {
+  return els.tree.querySelector(`.node[data-id="${id}"]`);
+}
+
+function onCreated(ev) {
+  const c = ev.comment;
+  if (nodeEl(c.id)) return;
+  const el = renderNode({ ...c, children: [] });
+
+  if (c.parent_id === 0) {
+    if (state.currentRootId) return;
+    els.tree.querySelector(".empty")?.remove();
+    if (state.sort === "created_at_asc") els.tree.appendChild(el);
+    else els.tree.prepend(el);
+    return;
+  }
+
+  const parent = nodeEl(c.parent_id);
+  if (!parent) return;
+  const firstChild = parent.querySelector(":scope > .node");
+  if (state.sort === "created_at_desc" && firstChild) parent.insertBefore(el, firstChild);
+  else parent.appendChild(el);
+}
+
+function onEdited(ev) {
+  const el = nodeEl(ev.comment.id);
+  if (!el) return;
+  el.querySelector(".nodeBody").textContent = ev.comment.text;
+  el.querySelector(".score").textContent = ev.comment.score ?? 0;
+}
+
+function onDeleted(ev) {
+  const el = nodeEl(ev.comment.id);
+  if (!el) return;
+  if (ev.comment.deleted_at) {
+    el.querySelector(".nodeBody").textContent = ev.comment.text;
+  } else {
+    el.remove();
+  }
+}
+
 async function loadRootTree() {
+  if (state.currentRootId || !stream) subscribe(null);
   state.currentRootId = null;
   state.highlightId = null;
   setStatus("Загружаю корневые комментарии…");
   const resp = await api.getTree(0, 1, 50, state.sort);
   if (!resp.ok) {
     const e = await safeJson(resp);
-    setStatus(`Ошибка загрузки: ${e?.error || resp.status}`, "err");
+    setStatus(`Ошибка загрузки: ${e?.detail || e?.title || resp.status}`, "err");
     return;
   }
   const data = await resp.json();
@@ -199,6 +297,7 @@ async function loadRootTree() {
 }
 
 async function loadSubtree(rootId, highlightId) {
+  if (state.currentRootId !== rootId) subscribe(rootId);
   state.currentRootId = rootId;
   state.highlightId = highlightId ?? null;
 
@@ -206,7 +305,7 @@ async function loadSubtree(rootId, highlightId) {
   const resp = await api.subtree(rootId, state.sort);
   if (!resp.ok) {
     const e = await safeJson(resp);
-    setStatus(`Ошибка ветки: ${e?.error || resp.status}`, "err");
+    setStatus(`Ошибка ветки: ${e?.detail || e?.title || resp.status}`, "err");
     return;
   }
   const node = await resp.json();
@@ -234,7 +333,7 @@ async function onSearch() {
   const resp = await api.search(q, 1, 20, "rank_desc");
   if (!resp.ok) {
     const e = await safeJson(resp);
-    setStatus(`Ошибка поиска: ${e?.error || resp.status}`, "err");
+    setStatus(`Ошибка поиска: ${e?.detail || e?.title || resp.status}`, "err");
     return;
   }
   const data = await resp.json();
@@ -257,7 +356,7 @@ function renderResults(items) {
     div.className = "resultItem";
     div.innerHTML = `
       <div class="snippet">${it.snippet}</div>
-      <div class="meta">id=${it.id} · parent=${it.parent_id} · rank=${Number(it.rank).toFixed(3)} · ${fmtDate(it.created_at)}</div>
+      <div class="meta">${authorLabel(it.author)} · id=${it.id} · parent=${it.parent_id} · rank=${Number(it.rank).toFixed(3)} · ${fmtDate(it.created_at)}</div>
       <button class="openBtn secondary">Открыть в дереве</button>
     `;
     div.querySelector(".openBtn").addEventListener("click", () => openInTree(it.id));
@@ -270,7 +369,7 @@ async function openInTree(id) {
   const resp = await api.path(id);
   if (!resp.ok) {
     const e = await safeJson(resp);
-    setStatus(`Ошибка path: ${e?.error || resp.status}`, "err");
+    setStatus(`Ошибка path: ${e?.detail || e?.title || resp.status}`, "err");
     return;
   }
   const data = await resp.json();
@@ -308,7 +407,7 @@ els.createRootBtn.addEventListener("click", async () => {
   const resp = await api.create(0, text);
   if (!resp.ok) {
     const e = await safeJson(resp);
-    return setStatus(`Ошибка создания: ${e?.error || resp.status}`, "err");
+    return setStatus(`Ошибка создания: ${e?.detail || e?.title || resp.status}`, "err");
   }
   els.newText.value = "";
   setStatus("Комментарий добавлен", "ok");